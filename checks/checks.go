@@ -0,0 +1,215 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/google/go-github/v62/github"
+)
+
+// State is the outcome of a run as reported to GitHub
+type State string
+
+const (
+	StatePending   State = "pending" // queued or running
+	StateSuccess   State = "success"
+	StateFailure   State = "failure"
+	StateTimedOut  State = "timed_out"
+	StateCancelled State = "cancelled"
+	StateSkipped   State = "skipped"
+)
+
+// requestTimeout limits a single report to GitHub
+const requestTimeout = 10 * time.Second
+
+// Target identifies the commit and run a report is about
+type Target struct {
+	Owner      string
+	Repo       string
+	SHA        string
+	Name       string // appended to the configured context, e.g. the project name
+	RunID      int64
+	CheckRunID int64 // check run created by an earlier report of the run, 0 if none
+}
+
+var (
+	client *github.Client
+	cfg    config.GitHubConfig
+)
+
+// Init sets up the GitHub client, reporting stays disabled unless configured
+func Init(githubCfg config.GitHubConfig) error {
+	if !githubCfg.Enabled() {
+		return nil
+	}
+
+	baseURL, err := url.Parse(githubCfg.APIURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse github api url: %w", err)
+	}
+
+	var c *github.Client
+	if githubCfg.AppID != 0 {
+		keyData := []byte(githubCfg.PrivateKey)
+		if len(keyData) == 0 {
+			keyData, err = os.ReadFile(githubCfg.PrivateKeyPath)
+			if err != nil {
+				return fmt.Errorf("failed to read github private key: %w", err)
+			}
+		}
+		key, err := parsePrivateKey(keyData)
+		if err != nil {
+			return err
+		}
+		c = github.NewClient(&http.Client{Transport: &appTransport{
+			appID:          githubCfg.AppID,
+			installationID: githubCfg.InstallationID,
+			key:            key,
+			baseURL:        baseURL,
+			base:           http.DefaultTransport,
+		}})
+	} else {
+		c = github.NewClient(nil).WithAuthToken(githubCfg.Token)
+	}
+	c.BaseURL = baseURL
+
+	client = c
+	cfg = githubCfg
+	return nil
+}
+
+// Enabled reports whether Init configured a client
+func Enabled() bool {
+	return client != nil
+}
+
+// CheckRuns reports whether runs are reported as check runs rather than commit statuses
+func CheckRuns() bool {
+	return client != nil && cfg.Report == "check_runs"
+}
+
+// RunURL returns the link to a run, or an empty string if none is configured
+func RunURL(runID int64) string {
+	if cfg.RunURL == "" {
+		return ""
+	}
+	return strings.ReplaceAll(cfg.RunURL, "{id}", strconv.FormatInt(runID, 10))
+}
+
+// Report publishes the state of a run on its commit, as a commit status or a
+// check run depending on the configuration. It returns the id of the check run,
+// which must be passed back in Target.CheckRunID for later reports of the same
+// run, and 0 for commit statuses.
+func Report(ctx context.Context, target Target, state State, description string) (int64, error) {
+	if client == nil || target.SHA == "" {
+		return target.CheckRunID, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	name := cfg.Context
+	if target.Name != "" {
+		name = cfg.Context + "/" + target.Name
+	}
+	// GitHub rejects longer descriptions
+	if runes := []rune(description); len(runes) > 140 {
+		description = string(runes[:137]) + "..."
+	}
+
+	if cfg.Report == "check_runs" {
+		return reportCheckRun(ctx, target, name, state, description)
+	}
+	return 0, reportStatus(ctx, target, name, state, description)
+}
+
+// reportStatus sets a commit status
+// Commit statuses have no skipped or cancelled states, skipped runs are not
+// reported and cancelled runs are reported as errors
+func reportStatus(ctx context.Context, target Target, name string, state State, description string) error {
+	var statusState string
+	switch state {
+	case StatePending:
+		statusState = "pending"
+	case StateSuccess:
+		statusState = "success"
+	case StateFailure, StateTimedOut:
+		statusState = "failure"
+	case StateCancelled:
+		statusState = "error"
+	default:
+		return nil
+	}
+
+	status := &github.RepoStatus{
+		State:       github.String(statusState),
+		Description: github.String(description),
+		Context:     github.String(name),
+	}
+	if runURL := RunURL(target.RunID); runURL != "" {
+		status.TargetURL = github.String(runURL)
+	}
+	if _, _, err := client.Repositories.CreateStatus(ctx, target.Owner, target.Repo, target.SHA, status); err != nil {
+		return fmt.Errorf("failed to create commit status: %w", err)
+	}
+	return nil
+}
+
+// reportCheckRun creates the check run of a run or updates the existing one
+func reportCheckRun(ctx context.Context, target Target, name string, state State, description string) (int64, error) {
+	output := &github.CheckRunOutput{
+		Title:   github.String(description),
+		Summary: github.String(description),
+	}
+	var detailsURL *string
+	if runURL := RunURL(target.RunID); runURL != "" {
+		detailsURL = github.String(runURL)
+	}
+
+	status := "completed"
+	var conclusion *string
+	var completedAt *github.Timestamp
+	if state == StatePending {
+		status = "in_progress"
+	} else {
+		conclusion = github.String(string(state))
+		completedAt = &github.Timestamp{Time: time.Now()}
+	}
+
+	if target.CheckRunID != 0 {
+		_, _, err := client.Checks.UpdateCheckRun(ctx, target.Owner, target.Repo, target.CheckRunID, github.UpdateCheckRunOptions{
+			Name:        name,
+			DetailsURL:  detailsURL,
+			Status:      github.String(status),
+			Conclusion:  conclusion,
+			CompletedAt: completedAt,
+			Output:      output,
+		})
+		if err != nil {
+			return target.CheckRunID, fmt.Errorf("failed to update check run: %w", err)
+		}
+		return target.CheckRunID, nil
+	}
+
+	checkRun, _, err := client.Checks.CreateCheckRun(ctx, target.Owner, target.Repo, github.CreateCheckRunOptions{
+		Name:        name,
+		HeadSHA:     target.SHA,
+		DetailsURL:  detailsURL,
+		ExternalID:  github.String(strconv.FormatInt(target.RunID, 10)),
+		Status:      github.String(status),
+		Conclusion:  conclusion,
+		CompletedAt: completedAt,
+		Output:      output,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create check run: %w", err)
+	}
+	return checkRun.GetID(), nil
+}
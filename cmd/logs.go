@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/database"
+	"github.com/spf13/cobra"
+)
+
+var (
+	logsFollow   bool
+	logsInterval time.Duration
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <run-id>",
+	Short: "Print the output of a run",
+	Long: `Print the output of a run (the trigger id) from the database.
+With --follow, keep printing new output until the run finishes.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		triggerID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid run id %q: %w", args[0], err)
+		}
+		if logsInterval <= 0 {
+			return fmt.Errorf("--interval must be positive, got %s", logsInterval)
+		}
+
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+
+		if err := database.InitDB(cfg); err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		defer database.Close()
+
+		var after int64
+		for {
+			// Read the status before the chunks, so output stored just before the
+			// run finished is still printed on the last pass
+			trigger, err := database.GetTrigger(triggerID)
+			if err != nil {
+				return err
+			}
+
+			for {
+				chunks, err := database.GetLogChunks(triggerID, after, 100)
+				if err != nil {
+					return err
+				}
+				if len(chunks) == 0 {
+					break
+				}
+				for _, chunk := range chunks {
+					fmt.Print(chunk.Content)
+					after = chunk.ID
+				}
+			}
+
+			if !logsFollow || trigger.Finished() {
+				return nil
+			}
+			time.Sleep(logsInterval)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "Keep printing output until the run finishes")
+	logsCmd.Flags().DurationVar(&logsInterval, "interval", time.Second, "Polling interval when following")
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/database"
+	"github.com/spf13/cobra"
+)
+
+var (
+	notificationsStatus string
+	notificationsLimit  int
+)
+
+var notificationsCmd = &cobra.Command{
+	Use:   "notifications",
+	Short: "List notifications of the outbox",
+	Long: `List the most recent notifications of the outbox from the database, newest
+first. Use --status dead to see the ones that were given up after the last
+attempt, and "notifications resend <id>" to send one again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch notificationsStatus {
+		case "", database.NotificationPending, database.NotificationSent, database.NotificationDead:
+		default:
+			return fmt.Errorf("invalid status %q, must be pending, sent or dead", notificationsStatus)
+		}
+
+		if err := initNotificationsDB(); err != nil {
+			return err
+		}
+		defer database.Close()
+
+		notifications, err := database.ListNotifications(notificationsStatus, notificationsLimit)
+		if err != nil {
+			return err
+		}
+		for _, n := range notifications {
+			fmt.Printf("%d\trun %d\t%s\t%s\t%s\tattempts %d\t%s\n",
+				n.ID,
+				n.TriggerID,
+				n.Project,
+				n.Target,
+				n.Status,
+				n.Attempts,
+				n.CreatedAt.Format("2006-01-02 15:04:05"),
+			)
+			if n.LastError != "" {
+				fmt.Printf("\t%s\n", strings.ReplaceAll(n.LastError, "\n", " "))
+			}
+		}
+		return nil
+	},
+}
+
+var notificationsResendCmd = &cobra.Command{
+	Use:   "resend <notification-id>...",
+	Short: "Send notifications again",
+	Long: `Make notifications pending again with fresh attempts. The running server
+sends them on its next poll.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ids := make([]int64, 0, len(args))
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid notification id %q: %w", arg, err)
+			}
+			ids = append(ids, id)
+		}
+
+		if err := initNotificationsDB(); err != nil {
+			return err
+		}
+		defer database.Close()
+
+		for _, id := range ids {
+			n, err := database.ResendNotification(id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("notification %d of run %d to %s is pending again\n", n.ID, n.TriggerID, n.Target)
+		}
+		return nil
+	},
+}
+
+// initNotificationsDB connects to the database of the configured server
+func initNotificationsDB() error {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := database.InitDB(cfg); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(notificationsCmd)
+	notificationsCmd.AddCommand(notificationsResendCmd)
+
+	notificationsCmd.Flags().StringVarP(&notificationsStatus, "status", "s", "", "Only list notifications with this status (pending, sent or dead)")
+	notificationsCmd.Flags().IntVarP(&notificationsLimit, "limit", "n", 20, "Maximum number of notifications to list")
+}
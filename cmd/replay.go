@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayDryRun bool
+	replayServer string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <delivery-id|run-id>",
+	Short: "Run an archived webhook delivery again",
+	Long: `Ask the running server to replay an archived webhook delivery through the
+same matching and execution path as a new webhook. A numeric argument is a
+run id (the trigger id) whose delivery is replayed for that run's project and
+environment only, anything else is a GitHub delivery id. Replays run even if the delivery was seen before.
+With --dry-run, only print which project and environment would run.
+The server must have api_token set in config.yml.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		if cfg.APIToken == "" {
+			return fmt.Errorf("api_token must be set in config.yml")
+		}
+
+		server := replayServer
+		if server == "" {
+			server = localServerURL(cfg.Addr)
+		}
+		path := "/deliveries/" + url.PathEscape(args[0]) + "/replay"
+		if _, err := strconv.ParseInt(args[0], 10, 64); err == nil {
+			path = "/runs/" + args[0] + "/replay"
+		}
+		endpoint := strings.TrimSuffix(server, "/") + path + "?dry_run=" + strconv.FormatBool(replayDryRun)
+
+		req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+		if err != nil {
+			return fmt.Errorf("failed to build request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+cfg.APIToken)
+
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to call server: %w", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("replay failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		fmt.Println(string(body))
+		return nil
+	},
+}
+
+// localServerURL returns the API base URL of a server listening on addr on this machine
+func localServerURL(addr string) string {
+	host := addr
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+	return "http://" + host + "/tool/github-sentry"
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().BoolVar(&replayDryRun, "dry-run", false, "Only report what would run")
+	replayCmd.Flags().StringVar(&replayServer, "server", "", "API base URL of the server (default: http://127.0.0.1<addr>/tool/github-sentry)")
+}
@@ -1,13 +1,23 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"log"
+	nethttp "net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/allintech/github-sentry/checks"
 	"github.com/allintech/github-sentry/config"
 	"github.com/allintech/github-sentry/database"
 	"github.com/allintech/github-sentry/http"
 	"github.com/allintech/github-sentry/logger"
 	"github.com/allintech/github-sentry/middleware"
+	"github.com/allintech/github-sentry/notify"
+	"github.com/allintech/github-sentry/outbox"
+	"github.com/allintech/github-sentry/queue"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
 )
@@ -25,6 +35,9 @@ func init() {
 	rootCmd.AddCommand(serveCmd)
 }
 
+// notifyDrainTimeout bounds how long shutdown waits for due notifications to be sent
+const notifyDrainTimeout = 15 * time.Second
+
 func runServer() {
 	cfg, err := config.LoadConfig()
 	if err != nil {
@@ -47,18 +60,101 @@ func runServer() {
 	}
 	defer database.Close()
 
+	// Initialize GitHub reporting, disabled unless configured
+	if err := checks.Init(cfg.GitHub); err != nil {
+		logger.LogError("failed to initialize GitHub reporting: %v", err)
+		log.Fatalf("failed to initialize GitHub reporting: %v", err)
+		return
+	}
+
+	// Fail on unknown notifier types now rather than on the first run
+	if err := notify.Validate(cfg.Notifiers); err != nil {
+		logger.LogError("invalid notifiers: %v", err)
+		log.Fatalf("invalid notifiers: %v", err)
+		return
+	}
+
 	app := gin.Default()
 	app.Use(gin.Recovery())
+	// Runs are stored in the jobs table and executed by the queue worker,
+	// one at a time per project (or concurrency group)
+	// Notifications are stored in the outbox and delivered by a background sender,
+	// which retries failed ones with backoff
+	sender := outbox.NewSender(context.Background(), cfg)
+	sender.Start()
+
+	runQueue := queue.NewManager(context.Background(), http.JobHandler(cfg, sender), cfg.Queue.Worker, cfg.Queue.PollInterval, cfg.Queue.RequeueInterrupted)
+	if err := runQueue.Recover(); err != nil {
+		logger.LogError("failed to recover interrupted jobs: %v", err)
+	}
+	runQueue.Start()
+
 	app.Use(middleware.InjectMiddleware("config", cfg))
+	app.Use(middleware.InjectMiddleware("queue", runQueue))
+	app.Use(middleware.InjectMiddleware("outbox", sender))
 	api := app.Group("/tool/github-sentry")
 
 	api.POST("/webhook", http.WebHook)
 	api.GET("/health", http.HealthCheck)
+	// Run summaries are public, GitHub statuses link to them
+	api.GET("/runs/:id", http.Run)
+
+	// Run history and step output may contain secrets, and replays start runs,
+	// so they need the API token
+	runs := api.Group("", middleware.RequireToken(cfg.APIToken))
+	runs.GET("/runs", http.Runs)
+	runs.GET("/runs/:id/logs", http.RunLogs)
+	runs.POST("/runs/:id/replay", http.ReplayRun)
+	runs.POST("/deliveries/:id/replay", http.ReplayDelivery)
 
-	logger.LogInfo("starting server on %s", cfg.Addr)
-	log.Printf("listening on %s", cfg.Addr)
-	if err := app.Run(cfg.Addr); err != nil {
-		logger.LogError("server error: %v", err)
-		log.Fatal(err)
+	// Failed notifications keep their last error, listing them needs the API token too
+	notifications := api.Group("/notifications", middleware.RequireToken(cfg.APIToken))
+	notifications.GET("", http.Notifications)
+	notifications.POST("/:id/resend", http.ResendNotification)
+
+	server := &nethttp.Server{
+		Addr:    cfg.Addr,
+		Handler: app,
+	}
+
+	// SIGTERM comes from systemd or `make stop`, SIGINT from Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.LogInfo("starting server on %s", cfg.Addr)
+		log.Printf("listening on %s", cfg.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, nethttp.ErrServerClosed) {
+			logger.LogError("server error: %v", err)
+			log.Fatal(err)
+		}
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Stop accepting webhooks, then give running jobs the drain timeout to finish
+	// Jobs still running afterwards have their commands terminated and are recorded as interrupted
+	logger.LogInfo("shutting down, waiting up to %s for running jobs", cfg.ShutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(drainCtx); err != nil {
+		logger.LogError("failed to shut down server: %v", err)
+	}
+	if err := runQueue.Shutdown(drainCtx); err != nil {
+		logger.LogError("running jobs were interrupted: %v", err)
+	}
+	// Give the notifications of drained jobs a last chance to go out
+	notifyCtx, cancelNotify := context.WithTimeout(context.Background(), notifyDrainTimeout)
+	defer cancelNotify()
+	if err := sender.Shutdown(notifyCtx); err != nil {
+		logger.LogError("pending notifications are left for the next start: %v", err)
 	}
+	logger.LogInfo("shutdown complete")
 }
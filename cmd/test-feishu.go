@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/allintech/github-sentry/config"
@@ -13,13 +14,20 @@ var (
 	testCommitID      string
 	testCommitMessage string
 	testBranch        string
+	testProject       string
+	testEnvironment   string
+	testStatus        string
 )
 
 var testFeishuCmd = &cobra.Command{
 	Use:   "test-feishu",
 	Short: "Test Feishu notification without using database",
 	Long: `Send a test notification to Feishu using the webhook URL and secret
-configured in config.yml. This command does not require database connection.`,
+configured in config.yml, or as the app bot when feishu.app_id is set, in which
+case the card is updated once after sending. This command does not require
+database connection.
+With --project, send it to every destination the project's notify routes
+select for --environment and --status instead.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Load config
 		cfg, err := config.LoadConfig()
@@ -27,11 +35,6 @@ configured in config.yml. This command does not require database connection.`,
 			return fmt.Errorf("failed to load config: %w", err)
 		}
 
-		// Validate Feishu config
-		if cfg.Feishu.WebhookURL == "" {
-			return fmt.Errorf("feishu.webhook_url must be set in config.yml")
-		}
-
 		// Set defaults if not provided
 		if testCommitID == "" {
 			testCommitID = "abc1234"
@@ -43,6 +46,19 @@ configured in config.yml. This command does not require database connection.`,
 			testBranch = "main"
 		}
 
+		if testProject != "" {
+			return testProjectRoute(cfg)
+		}
+
+		if cfg.Feishu.AppID != "" {
+			return testFeishuApp(cfg)
+		}
+
+		// Validate Feishu config
+		if cfg.Feishu.WebhookURL == "" {
+			return fmt.Errorf("feishu.webhook_url must be set in config.yml")
+		}
+
 		fmt.Printf("Sending test notification to Feishu...\n")
 		fmt.Printf("  Webhook URL: %s\n", cfg.Feishu.WebhookURL)
 		if cfg.Feishu.WebhookSecret != "" {
@@ -55,18 +71,20 @@ configured in config.yml. This command does not require database connection.`,
 		fmt.Printf("  Branch: %s\n", testBranch)
 		fmt.Println()
 
-		// Send notification (default to success status for testing)
-		err = notify.NotifyWithSecret(
-			cfg.Feishu.WebhookURL,
-			cfg.Feishu.WebhookSecret,
-			notify.StatusSuccess,
-			"test/repo",
-			"test-user",
-			testCommitID,
-			testCommitMessage,
-			testBranch,
-			time.Now(),
-		)
+		// Send through the same notifier runs use (default to success status for testing)
+		notifier, err := notify.New(cfg.Feishu.Notifier())
+		if err != nil {
+			return err
+		}
+		err = notifier.Notify(notify.Message{
+			Status:        notify.StatusSuccess,
+			Repo:          "test/repo",
+			Author:        "test-user",
+			CommitID:      testCommitID,
+			CommitMessage: testCommitMessage,
+			Branch:        testBranch,
+			CommitTime:    time.Now(),
+		})
 		if err != nil {
 			return fmt.Errorf("failed to send notification: %w", err)
 		}
@@ -76,6 +94,102 @@ configured in config.yml. This command does not require database connection.`,
 	},
 }
 
+// testFeishuApp sends a test card as the Feishu app bot and updates it, as runs do
+func testFeishuApp(cfg *config.Config) error {
+	fmt.Printf("Sending test card as Feishu app %s to chat %s...\n", cfg.Feishu.AppID, cfg.Feishu.ChatID)
+
+	notifier, err := notify.New(cfg.Feishu.Notifier())
+	if err != nil {
+		return err
+	}
+	updater, ok := notifier.(notify.Updater)
+	if !ok {
+		return fmt.Errorf("feishu app notifier cannot update cards")
+	}
+	msg := notify.Message{
+		Status:        notify.StatusStarted,
+		Repo:          "test/repo",
+		Author:        "test-user",
+		CommitID:      testCommitID,
+		CommitMessage: testCommitMessage,
+		Branch:        testBranch,
+		CommitTime:    time.Now(),
+	}
+	messageID, err := updater.Send(msg)
+	if err != nil {
+		return fmt.Errorf("failed to send card: %w", err)
+	}
+	fmt.Printf("✅ Card sent (message id %s)\n", messageID)
+
+	msg.Status = notify.StatusSuccess
+	msg.Steps = []notify.StepResult{{Name: "test", Status: "success", Duration: time.Second, ExitCode: 0}}
+	msg.Duration = time.Second
+	if err := updater.Update(messageID, msg); err != nil {
+		return fmt.Errorf("failed to update card: %w", err)
+	}
+	fmt.Println("✅ Card updated to success")
+	return nil
+}
+
+// testProjectRoute sends a test notification to the destinations routed for a project
+func testProjectRoute(cfg *config.Config) error {
+	project, ok := cfg.Commands[testProject]
+	if !ok {
+		return fmt.Errorf("project %s is not configured", testProject)
+	}
+	if testEnvironment != "" {
+		if _, ok := project.Environments[testEnvironment]; !ok {
+			return fmt.Errorf("environment %s of project %s is not configured", testEnvironment, testProject)
+		}
+	}
+
+	if err := config.ValidateNotifyStatus(testStatus); err != nil {
+		return err
+	}
+	testStatus = strings.ToLower(testStatus)
+
+	names := cfg.NotifyTargetNames(testProject, testEnvironment, testStatus)
+	if len(names) == 0 {
+		return fmt.Errorf("no notification routes of project %s match status %s", testProject, testStatus)
+	}
+
+	msg := notify.Message{
+		Status:        notify.NotificationStatus(testStatus),
+		Repo:          project.Organization + "/" + project.Repo,
+		Project:       testProject,
+		Environment:   testEnvironment,
+		Author:        "test-user",
+		CommitID:      testCommitID,
+		CommitMessage: testCommitMessage,
+		Branch:        testBranch,
+		CommitTime:    time.Now(),
+	}
+	// Destination URLs carry access tokens, so only names and types are printed
+	failed := 0
+	for _, name := range names {
+		target, ok := cfg.NotifyTarget(testProject, testEnvironment, name)
+		if !ok {
+			failed++
+			fmt.Printf("❌ %s: not configured\n", name)
+			continue
+		}
+		notifier, err := notify.New(target)
+		if err == nil {
+			err = notifier.Notify(msg)
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("❌ %s (%s): %v\n", name, target.Type, err)
+			continue
+		}
+		fmt.Printf("✅ %s (%s)\n", name, target.Type)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d notifications failed", failed, len(names))
+	}
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(testFeishuCmd)
 
@@ -83,5 +197,8 @@ func init() {
 	testFeishuCmd.Flags().StringVarP(&testCommitID, "commit-id", "c", "", "Commit ID (default: abc1234)")
 	testFeishuCmd.Flags().StringVarP(&testCommitMessage, "message", "m", "", "Commit message (default: 'Test commit message')")
 	testFeishuCmd.Flags().StringVarP(&testBranch, "branch", "b", "", "Branch name (default: main)")
+	testFeishuCmd.Flags().StringVarP(&testProject, "project", "p", "", "Send to the notification routes of this project")
+	testFeishuCmd.Flags().StringVarP(&testEnvironment, "environment", "e", "", "Environment of the project whose routes are used")
+	testFeishuCmd.Flags().StringVarP(&testStatus, "status", "s", "success", "Run status the routes are selected for")
 }
 
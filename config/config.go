@@ -2,7 +2,13 @@ package config
 
 import (
 	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 )
 
@@ -18,24 +24,446 @@ type DatabaseConfig struct {
 type FeishuConfig struct {
 	WebhookURL    string `mapstructure:"webhook_url"`
 	WebhookSecret string `mapstructure:"webhook_secret"`
+	// App bot mode, used instead of the webhook when app_id is set: the card of
+	// a run is sent once to chat_id and updated in place as the run progresses
+	AppID     string `mapstructure:"app_id"`
+	AppSecret string `mapstructure:"app_secret"`
+	ChatID    string `mapstructure:"chat_id"`
+	APIURL    string `mapstructure:"api_url"` // Open platform base URL, defaults to https://open.feishu.cn
+}
+
+// Enabled reports whether a Feishu destination is configured
+func (f FeishuConfig) Enabled() bool {
+	return f.WebhookURL != "" || f.AppID != ""
+}
+
+// Notifier returns the Feishu destination as a notifier
+func (f FeishuConfig) Notifier() NotifierConfig {
+	if f.AppID != "" {
+		return NotifierConfig{Type: FeishuAppType, URL: f.APIURL, AppID: f.AppID, Secret: f.AppSecret, ChatID: f.ChatID}
+	}
+	return NotifierConfig{Type: "feishu", URL: f.WebhookURL, Secret: f.WebhookSecret}
+}
+
+// FeishuAppType is the notifier type of Feishu app bots
+const FeishuAppType = "feishu_app"
+
+// defaultFeishuAPIURL is the open platform base URL of Feishu app bots
+const defaultFeishuAPIURL = "https://open.feishu.cn"
+
+// NotifierConfig is a notification destination
+type NotifierConfig struct {
+	Type    string `mapstructure:"type"`    // feishu (default), feishu_app, slack, dingtalk, wecom or webhook
+	URL     string `mapstructure:"url"`     // Incoming webhook or robot URL, the open platform base URL of feishu_app
+	Secret  string `mapstructure:"secret"`  // Signing secret of feishu and dingtalk robots, HMAC key of generic webhooks, app secret of feishu_app
+	AppID   string `mapstructure:"app_id"`  // feishu_app only
+	ChatID  string `mapstructure:"chat_id"` // feishu_app only, the group chat cards are sent to
+	Default bool   `mapstructure:"default"` // Also receives notifications of projects without notify routes
+}
+
+// StepConfig describes a single command to run for a project
+// In config.yml a step is either a plain command string or an object with these fields
+type StepConfig struct {
+	Name         string        `mapstructure:"name"`          // Display name, defaults to the command
+	Command      string        `mapstructure:"command"`       // Shell command or script path
+	Dir          string        `mapstructure:"dir"`           // Working directory, defaults to the server's
+	Env          []string      `mapstructure:"env"`           // Extra environment variables as KEY=VALUE
+	Timeout      time.Duration `mapstructure:"timeout"`       // Overrides the project timeout
+	Retries      int           `mapstructure:"retries"`       // Extra attempts after a failure
+	AllowFailure bool          `mapstructure:"allow_failure"` // Failure does not stop the run
+	Needs        []string      `mapstructure:"needs"`         // Names of steps that must finish first (steps only)
+}
+
+// DisplayName returns the step name, falling back to its command
+func (s StepConfig) DisplayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Command
+}
+
+// ConcurrencyConfig controls how runs of a project are queued
+// Runs in the same group never execute at the same time
+type ConcurrencyConfig struct {
+	Group  string `mapstructure:"group"`  // Defaults to the project name
+	Policy string `mapstructure:"policy"` // queue (default), cancel-in-progress or skip-pending
+}
+
+// EnvironmentConfig is a deployment target of a project, selected by the pushed branch,
+// the pushed tag or the tag of a published release
+// Steps and timeout fall back to the project's when the environment does not set them
+type EnvironmentConfig struct {
+	Branches   []string            `mapstructure:"branches"`
+	Tags       []string            `mapstructure:"tags"`
+	Releases   []string            `mapstructure:"releases"`
+	Sequential []StepConfig        `mapstructure:"sequential"`
+	Async      []StepConfig        `mapstructure:"async"`
+	Steps      []StepConfig        `mapstructure:"steps"`
+	Timeout    time.Duration       `mapstructure:"timeout"`
+	Env        []string            `mapstructure:"env"`    // Extra environment variables for every step as KEY=VALUE
+	Feishu     FeishuConfig        `mapstructure:"feishu"` // Overrides the global Feishu destination
+	Actors     ActorsConfig        `mapstructure:"actors"` // Applies on top of the project's actors
+	Notify     []NotifyRouteConfig `mapstructure:"notify"` // Replaces the project's notification routes
+
+	refRules refRules
+}
+
+// hasSteps reports whether the environment defines its own steps
+func (e EnvironmentConfig) hasSteps() bool {
+	return len(e.Sequential) > 0 || len(e.Async) > 0 || len(e.Steps) > 0
+}
+
+// PullRequestConfig describes the checks run for pull requests of a project
+type PullRequestConfig struct {
+	Branches   []string      `mapstructure:"branches"` // Base branch patterns, defaults to all branches
+	Actions    []string      `mapstructure:"actions"`  // Defaults to opened, synchronize and reopened
+	Sequential []StepConfig  `mapstructure:"sequential"`
+	Async      []StepConfig  `mapstructure:"async"`
+	Steps      []StepConfig  `mapstructure:"steps"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+
+	branchRules []refRule
+}
+
+// pullRequestActions are the pull_request event actions that can trigger checks
+var pullRequestActions = []string{"opened", "synchronize", "reopened", "closed"}
+
+// Enabled reports whether the project runs checks for pull requests
+func (p PullRequestConfig) Enabled() bool {
+	return len(p.Sequential) > 0 || len(p.Async) > 0 || len(p.Steps) > 0
+}
+
+// Match reports whether a pull request event with the given action and base branch runs the checks
+func (p PullRequestConfig) Match(action, baseBranch string) bool {
+	if !p.Enabled() {
+		return false
+	}
+	handled := false
+	for _, a := range p.Actions {
+		if a == action {
+			handled = true
+		}
+	}
+	return handled && matchRules(p.branchRules, baseBranch)
 }
 
 type CommandsConfig struct {
-	Organization string   `mapstructure:"organization"`
-	Repo         string   `mapstructure:"repo"`
-	Sequential   []string `mapstructure:"sequential"`
-	Async        []string `mapstructure:"async"`
+	Organization  string                       `mapstructure:"organization"`
+	Repo          string                       `mapstructure:"repo"`
+	Branches      []string                     `mapstructure:"branches"` // Branch patterns to deploy from, defaults to staging_branch
+	Tags          []string                     `mapstructure:"tags"`     // Tag patterns whose pushes deploy
+	Releases      []string                     `mapstructure:"releases"` // Tag patterns of published releases that deploy
+	Sequential    []StepConfig                 `mapstructure:"sequential"`
+	Async         []StepConfig                 `mapstructure:"async"`
+	Steps         []StepConfig                 `mapstructure:"steps"`   // Dependency graph, exclusive with sequential/async
+	Timeout       time.Duration                `mapstructure:"timeout"` // Default timeout for each command, 0 means no timeout
+	Concurrency   ConcurrencyConfig            `mapstructure:"concurrency"`
+	Environments  map[string]EnvironmentConfig `mapstructure:"environments"` // Exclusive with branches, tags and releases
+	PullRequests  PullRequestConfig            `mapstructure:"pull_requests"`
+	WebhookSecret WebhookSecretConfig          `mapstructure:"webhook_secret"` // Overrides webhook_secrets and github_webhook_secret for the repo
+	SkipMarkers   []string                     `mapstructure:"skip_markers"`   // Commit message markers that skip a push, defaults to [skip sentry] and [skip deploy]
+	Actors        ActorsConfig                 `mapstructure:"actors"`         // Pushers and senders that may trigger runs
+	Paths         []string                     `mapstructure:"paths"`          // Branch pushes only run if a changed file matches
+	PathsIgnore   []string                     `mapstructure:"paths_ignore"`   // Branch pushes only changing matching files do not run
+	Notify        []NotifyRouteConfig          `mapstructure:"notify"`         // Notification routes, defaults to feishu and every notifier
+
+	refRules  refRules
+	pathRules pathRules
+}
+
+// Match reports whether a ref of the given kind (RefBranch, RefTag or RefRelease)
+// should run this project and returns the name of the matching environment,
+// which is empty for projects without environments. Environments are tried in
+// name order.
+func (c CommandsConfig) Match(kind, name string) (string, bool) {
+	if len(c.Environments) == 0 {
+		return "", c.refRules.match(kind, name)
+	}
+	names := make([]string, 0, len(c.Environments))
+	for environment := range c.Environments {
+		names = append(names, environment)
+	}
+	sort.Strings(names)
+	for _, environment := range names {
+		if c.Environments[environment].refRules.match(kind, name) {
+			return environment, true
+		}
+	}
+	return "", false
+}
+
+// ForPullRequest returns the project with the pull request steps and timeout applied
+func (c CommandsConfig) ForPullRequest() CommandsConfig {
+	c.Sequential = c.PullRequests.Sequential
+	c.Async = c.PullRequests.Async
+	c.Steps = c.PullRequests.Steps
+	if c.PullRequests.Timeout > 0 {
+		c.Timeout = c.PullRequests.Timeout
+	}
+	return c
+}
+
+// ForEnvironment returns the project with the steps and timeout of an environment applied
+// An empty name returns the project unchanged
+func (c CommandsConfig) ForEnvironment(name string) (CommandsConfig, bool) {
+	if name == "" {
+		return c, true
+	}
+	environment, ok := c.Environments[name]
+	if !ok {
+		return c, false
+	}
+	if environment.hasSteps() {
+		c.Sequential = environment.Sequential
+		c.Async = environment.Async
+		c.Steps = environment.Steps
+	}
+	if environment.Timeout > 0 {
+		c.Timeout = environment.Timeout
+	}
+	return c, true
+}
+
+// TimeoutFor returns the timeout for a step, its own or the project default
+func (c CommandsConfig) TimeoutFor(step StepConfig) time.Duration {
+	if step.Timeout > 0 {
+		return step.Timeout
+	}
+	return c.Timeout
+}
+
+// stringToStepHookFunc lets a step be written as a bare command string
+func stringToStepHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(StepConfig{}) {
+			return data, nil
+		}
+		return StepConfig{Command: data.(string)}, nil
+	}
+}
+
+// validateSteps checks the step list of a project
+func validateSteps(projectName, field string, steps []StepConfig) error {
+	prefix := "commands." + projectName + "." + field
+	for _, step := range steps {
+		if step.Command == "" {
+			return errors.New(prefix + " entries must set command")
+		}
+		if step.Timeout < 0 {
+			return errors.New(prefix + " timeout for " + step.DisplayName() + " must not be negative")
+		}
+		if step.Retries < 0 {
+			return errors.New(prefix + " retries for " + step.DisplayName() + " must not be negative")
+		}
+		for _, env := range step.Env {
+			if !strings.Contains(env, "=") {
+				return errors.New(prefix + " env for " + step.DisplayName() + " must be KEY=VALUE, got " + env)
+			}
+		}
+		if !strings.HasSuffix(field, "steps") && len(step.Needs) > 0 {
+			return errors.New(prefix + " step " + step.DisplayName() + " cannot set needs, use steps instead")
+		}
+	}
+	return nil
+}
+
+// validateGraph checks that step names are unique, every need refers to a
+// known step and that the steps do not depend on each other in a cycle
+func validateGraph(projectName, field string, steps []StepConfig) error {
+	prefix := "commands." + projectName + "." + field
+	byName := make(map[string]StepConfig, len(steps))
+	for _, step := range steps {
+		if _, exists := byName[step.DisplayName()]; exists {
+			return errors.New(prefix + " has more than one step named " + step.DisplayName())
+		}
+		byName[step.DisplayName()] = step
+	}
+	for _, step := range steps {
+		for _, need := range step.Needs {
+			if _, exists := byName[need]; !exists {
+				return errors.New(prefix + " step " + step.DisplayName() + " needs unknown step " + need)
+			}
+		}
+	}
+
+	// Depth-first search, a step seen again while still being visited closes a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(steps))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return errors.New(prefix + " has a dependency cycle through " + name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, need := range byName[name].Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, step := range steps {
+		if err := visit(step.DisplayName()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateEnvironment checks an environment of a project and compiles its branch patterns
+func validateEnvironment(projectName, environmentName string, environment *EnvironmentConfig) error {
+	prefix := "commands." + projectName + ".environments." + environmentName
+	if len(environment.Branches) == 0 && len(environment.Tags) == 0 && len(environment.Releases) == 0 {
+		return errors.New(prefix + " must set branches, tags or releases in config.yml")
+	}
+	refRules, err := compileRefRules(prefix, environment.Branches, environment.Tags, environment.Releases)
+	if err != nil {
+		return err
+	}
+	environment.refRules = refRules
+	if environment.Timeout < 0 {
+		return errors.New(prefix + ".timeout must not be negative")
+	}
+	for _, env := range environment.Env {
+		if !strings.Contains(env, "=") {
+			return errors.New(prefix + ".env must be KEY=VALUE, got " + env)
+		}
+	}
+	field := "environments." + environmentName + "."
+	if err := validateSteps(projectName, field+"sequential", environment.Sequential); err != nil {
+		return err
+	}
+	if err := validateSteps(projectName, field+"async", environment.Async); err != nil {
+		return err
+	}
+	if err := validateSteps(projectName, field+"steps", environment.Steps); err != nil {
+		return err
+	}
+	if len(environment.Steps) > 0 {
+		if len(environment.Sequential) > 0 || len(environment.Async) > 0 {
+			return errors.New(prefix + " cannot combine steps with sequential or async")
+		}
+		if err := validateGraph(projectName, field+"steps", environment.Steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePullRequests checks the pull request checks of a project and applies their defaults
+func validatePullRequests(projectName string, pullRequests *PullRequestConfig) error {
+	prefix := "commands." + projectName + ".pull_requests"
+	if !pullRequests.Enabled() {
+		if len(pullRequests.Branches) > 0 || len(pullRequests.Actions) > 0 {
+			return errors.New(prefix + " must set sequential, async or steps")
+		}
+		return nil
+	}
+	branches := pullRequests.Branches
+	if len(branches) == 0 {
+		branches = []string{"**"}
+	}
+	branchRules, err := compilePatterns(prefix+".branches", branches)
+	if err != nil {
+		return err
+	}
+	pullRequests.branchRules = branchRules
+	if len(pullRequests.Actions) == 0 {
+		pullRequests.Actions = []string{"opened", "synchronize", "reopened"}
+	}
+	for _, action := range pullRequests.Actions {
+		valid := false
+		for _, known := range pullRequestActions {
+			if action == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return errors.New(prefix + ".actions must be opened, synchronize, reopened or closed, got " + action)
+		}
+	}
+	if pullRequests.Timeout < 0 {
+		return errors.New(prefix + ".timeout must not be negative")
+	}
+	if err := validateSteps(projectName, "pull_requests.sequential", pullRequests.Sequential); err != nil {
+		return err
+	}
+	if err := validateSteps(projectName, "pull_requests.async", pullRequests.Async); err != nil {
+		return err
+	}
+	if err := validateSteps(projectName, "pull_requests.steps", pullRequests.Steps); err != nil {
+		return err
+	}
+	if len(pullRequests.Steps) > 0 {
+		if len(pullRequests.Sequential) > 0 || len(pullRequests.Async) > 0 {
+			return errors.New(prefix + " cannot combine steps with sequential or async")
+		}
+		if err := validateGraph(projectName, "pull_requests.steps", pullRequests.Steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GitHubConfig enables reporting run results back to GitHub
+// Authenticate either with a token or as a GitHub App installation
+type GitHubConfig struct {
+	APIURL         string `mapstructure:"api_url"` // Defaults to https://api.github.com/
+	Token          string `mapstructure:"token"`   // Personal access or fine-grained token
+	AppID          int64  `mapstructure:"app_id"`  // GitHub App authentication, needs installation_id and a private key
+	InstallationID int64  `mapstructure:"installation_id"`
+	PrivateKey     string `mapstructure:"private_key"` // PEM encoded, or use private_key_path
+	PrivateKeyPath string `mapstructure:"private_key_path"`
+	Report         string `mapstructure:"report"`  // statuses (default) or check_runs, which requires app authentication
+	Context        string `mapstructure:"context"` // Status context or check run name prefix, defaults to github-sentry
+	RunURL         string `mapstructure:"run_url"` // Link to a run, {id} is replaced with the run id
+}
+
+// Enabled reports whether results are reported to GitHub
+func (g GitHubConfig) Enabled() bool {
+	return g.Token != "" || g.AppID != 0
+}
+
+// QueueConfig controls the durable run queue
+type QueueConfig struct {
+	Worker             string        `mapstructure:"worker"`              // Name of this instance in the jobs table, defaults to the hostname
+	PollInterval       time.Duration `mapstructure:"poll_interval"`       // How often idle workers look for jobs
+	RequeueInterrupted bool          `mapstructure:"requeue_interrupted"` // Run jobs interrupted by a restart again
+}
+
+// NotificationsConfig controls delivery of notifications from the outbox
+// Failed attempts are retried with exponential backoff, starting at backoff and
+// doubling up to max_backoff, until max_attempts is reached
+type NotificationsConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"` // How often the sender looks for due notifications
+	MaxAttempts  int           `mapstructure:"max_attempts"`  // Attempts before a notification is marked dead
+	Backoff      time.Duration `mapstructure:"backoff"`       // Delay after the first failed attempt
+	MaxBackoff   time.Duration `mapstructure:"max_backoff"`   // Upper bound of the delay between attempts
 }
 
 type Config struct {
-	GitHubWebhookSecret string                    `mapstructure:"github_webhook_secret"`
-	Addr                string                     `mapstructure:"addr"`
-	StagingBranch       string                     `mapstructure:"staging_branch"`
-	ScriptsFolder       string                     `mapstructure:"scripts_folder"` // Deprecated: use commands instead
-	LogFolder           string                     `mapstructure:"log_folder"`
-	Commands            map[string]CommandsConfig  `mapstructure:"commands"`
-	Database            DatabaseConfig              `mapstructure:"database"`
-	Feishu              FeishuConfig                `mapstructure:"feishu"`
+	GitHubWebhookSecret WebhookSecretConfig            `mapstructure:"github_webhook_secret"`
+	WebhookSecretsByOrg map[string]WebhookSecretConfig `mapstructure:"webhook_secrets"` // By organization, overrides github_webhook_secret
+	Addr                string                         `mapstructure:"addr"`
+	StagingBranch       string                         `mapstructure:"staging_branch"`
+	ScriptsFolder       string                         `mapstructure:"scripts_folder"` // Deprecated: use commands instead
+	LogFolder           string                         `mapstructure:"log_folder"`
+	Commands            map[string]CommandsConfig      `mapstructure:"commands"`
+	Database            DatabaseConfig                 `mapstructure:"database"`
+	Feishu              FeishuConfig                   `mapstructure:"feishu"`
+	Notifiers           map[string]NotifierConfig      `mapstructure:"notifiers"` // Additional destinations by name, selected by notify routes
+	Notifications       NotificationsConfig            `mapstructure:"notifications"`
+	Queue               QueueConfig                    `mapstructure:"queue"`
+	GitHub              GitHubConfig                   `mapstructure:"github"`
+	ShutdownTimeout     time.Duration                  `mapstructure:"shutdown_timeout"` // How long running jobs may finish on shutdown
+	APIToken            string                         `mapstructure:"api_token"`        // Bearer token of the runs and replay API, which is disabled without it
 }
 
 func LoadConfig() (*Config, error) {
@@ -50,16 +478,31 @@ func LoadConfig() (*Config, error) {
 	}
 
 	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		stringToStepHookFunc(),
+		stringToWebhookSecretHookFunc(),
+		stringToNotifyRouteHookFunc(),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToSliceHookFunc(","),
+	))
+	if err := v.Unmarshal(&cfg, decodeHook); err != nil {
 		return nil, err
 	}
 
-	if cfg.GitHubWebhookSecret == "" {
+	if !cfg.hasWebhookSecret() {
 		return nil, errors.New("github_webhook_secret must be set in config.yml")
 	}
-
-	if cfg.StagingBranch == "" {
-		return nil, errors.New("staging_branch must be set in config.yml")
+	if err := validateWebhookSecret("github_webhook_secret", cfg.GitHubWebhookSecret); err != nil {
+		return nil, err
+	}
+	for orgName, secret := range cfg.WebhookSecretsByOrg {
+		if secret.Secret == "" {
+			return nil, errors.New("webhook_secrets." + orgName + ".secret must be set")
+		}
+		if err := validateWebhookSecret("webhook_secrets."+orgName, secret); err != nil {
+			return nil, err
+		}
 	}
 
 	if cfg.LogFolder == "" {
@@ -77,7 +520,90 @@ func LoadConfig() (*Config, error) {
 			if projectCommands.Repo == "" {
 				return nil, errors.New("commands." + projectName + ".repo must be set in config.yml")
 			}
-			if len(projectCommands.Sequential) > 0 || len(projectCommands.Async) > 0 {
+			if projectCommands.Timeout < 0 {
+				return nil, errors.New("commands." + projectName + ".timeout must not be negative")
+			}
+			if err := validateWebhookSecret("commands."+projectName+".webhook_secret", projectCommands.WebhookSecret); err != nil {
+				return nil, err
+			}
+			if projectCommands.SkipMarkers == nil {
+				projectCommands.SkipMarkers = defaultSkipMarkers
+			}
+			pathRules, err := compilePathRules("commands."+projectName, projectCommands.Paths, projectCommands.PathsIgnore)
+			if err != nil {
+				return nil, err
+			}
+			projectCommands.pathRules = pathRules
+			// Projects without branches, tags, releases or environments deploy from the global staging branch
+			hasRefs := len(projectCommands.Branches) > 0 || len(projectCommands.Tags) > 0 || len(projectCommands.Releases) > 0
+			if len(projectCommands.Environments) > 0 {
+				if hasRefs {
+					return nil, errors.New("commands." + projectName + " cannot combine branches, tags or releases with environments, set them on each environment")
+				}
+			} else {
+				branches := projectCommands.Branches
+				if !hasRefs {
+					if cfg.StagingBranch == "" {
+						return nil, errors.New("commands." + projectName + ".branches or staging_branch must be set in config.yml")
+					}
+					branches = []string{cfg.StagingBranch}
+				}
+				refRules, err := compileRefRules("commands."+projectName, branches, projectCommands.Tags, projectCommands.Releases)
+				if err != nil {
+					return nil, err
+				}
+				projectCommands.refRules = refRules
+			}
+			if err := validatePullRequests(projectName, &projectCommands.PullRequests); err != nil {
+				return nil, err
+			}
+			if err := validateNotifyRoutes(&cfg, "commands."+projectName, projectCommands.Notify, FeishuConfig{}); err != nil {
+				return nil, err
+			}
+			for environmentName, environment := range projectCommands.Environments {
+				if err := validateEnvironment(projectName, environmentName, &environment); err != nil {
+					return nil, err
+				}
+				if err := validateFeishu("commands."+projectName+".environments."+environmentName+".feishu", &environment.Feishu); err != nil {
+					return nil, err
+				}
+				if err := validateNotifyRoutes(&cfg, "commands."+projectName+".environments."+environmentName, environment.Notify, environment.Feishu); err != nil {
+					return nil, err
+				}
+				projectCommands.Environments[environmentName] = environment
+				if environment.hasSteps() {
+					hasCommands = true
+				}
+			}
+			if projectCommands.Concurrency.Group == "" {
+				projectCommands.Concurrency.Group = projectName
+			}
+			switch projectCommands.Concurrency.Policy {
+			case "":
+				projectCommands.Concurrency.Policy = "queue"
+			case "queue", "cancel-in-progress", "skip-pending":
+			default:
+				return nil, errors.New("commands." + projectName + ".concurrency.policy must be queue, cancel-in-progress or skip-pending")
+			}
+			cfg.Commands[projectName] = projectCommands
+			if err := validateSteps(projectName, "sequential", projectCommands.Sequential); err != nil {
+				return nil, err
+			}
+			if err := validateSteps(projectName, "async", projectCommands.Async); err != nil {
+				return nil, err
+			}
+			if err := validateSteps(projectName, "steps", projectCommands.Steps); err != nil {
+				return nil, err
+			}
+			if len(projectCommands.Steps) > 0 {
+				if len(projectCommands.Sequential) > 0 || len(projectCommands.Async) > 0 {
+					return nil, errors.New("commands." + projectName + " cannot combine steps with sequential or async")
+				}
+				if err := validateGraph(projectName, "steps", projectCommands.Steps); err != nil {
+					return nil, err
+				}
+			}
+			if len(projectCommands.Sequential) > 0 || len(projectCommands.Async) > 0 || len(projectCommands.Steps) > 0 || projectCommands.PullRequests.Enabled() {
 				hasCommands = true
 			}
 		}
@@ -94,8 +620,28 @@ func LoadConfig() (*Config, error) {
 		return nil, errors.New("database.dbname must be set in config.yml")
 	}
 
-	if cfg.Feishu.WebhookURL == "" {
-		return nil, errors.New("feishu.webhook_url must be set in config.yml")
+	if !cfg.Feishu.Enabled() && len(cfg.Notifiers) == 0 {
+		return nil, errors.New("feishu.webhook_url, feishu.app_id or notifiers must be set in config.yml")
+	}
+	if err := validateFeishu("feishu", &cfg.Feishu); err != nil {
+		return nil, err
+	}
+	for name, notifier := range cfg.Notifiers {
+		if notifier.Type == FeishuAppType {
+			if notifier.AppID == "" || notifier.Secret == "" || notifier.ChatID == "" {
+				return nil, errors.New("notifiers." + name + " of type feishu_app must set app_id, secret and chat_id")
+			}
+			if notifier.URL == "" {
+				notifier.URL = defaultFeishuAPIURL
+			}
+		}
+		if notifier.URL == "" {
+			return nil, errors.New("notifiers." + name + ".url must be set in config.yml")
+		}
+		if notifier.Type == "" {
+			notifier.Type = "feishu"
+		}
+		cfg.Notifiers[name] = notifier
 	}
 	// WebhookSecret is optional - only required if using custom bot with signature
 
@@ -108,5 +654,70 @@ func LoadConfig() (*Config, error) {
 		cfg.Database.SSLMode = "disable"
 	}
 
+	if cfg.GitHub.Enabled() {
+		if cfg.GitHub.Token != "" && cfg.GitHub.AppID != 0 {
+			return nil, errors.New("github.token and github.app_id cannot both be set in config.yml")
+		}
+		if cfg.GitHub.AppID != 0 {
+			if cfg.GitHub.InstallationID == 0 {
+				return nil, errors.New("github.installation_id must be set in config.yml when using app_id")
+			}
+			if cfg.GitHub.PrivateKey == "" && cfg.GitHub.PrivateKeyPath == "" {
+				return nil, errors.New("github.private_key or github.private_key_path must be set in config.yml when using app_id")
+			}
+		}
+		switch cfg.GitHub.Report {
+		case "":
+			cfg.GitHub.Report = "statuses"
+		case "statuses":
+		case "check_runs":
+			if cfg.GitHub.AppID == 0 {
+				return nil, errors.New("github.report check_runs requires github.app_id, tokens cannot create check runs")
+			}
+		default:
+			return nil, errors.New("github.report must be statuses or check_runs")
+		}
+		if cfg.GitHub.APIURL == "" {
+			cfg.GitHub.APIURL = "https://api.github.com/"
+		}
+		if !strings.HasSuffix(cfg.GitHub.APIURL, "/") {
+			cfg.GitHub.APIURL += "/"
+		}
+		if cfg.GitHub.Context == "" {
+			cfg.GitHub.Context = "github-sentry"
+		}
+	}
+
+	if cfg.Queue.Worker == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.New("queue.worker must be set when the hostname is unknown")
+		}
+		cfg.Queue.Worker = hostname
+	}
+	if cfg.Queue.PollInterval <= 0 {
+		cfg.Queue.PollInterval = 2 * time.Second
+	}
+
+	if cfg.Notifications.PollInterval <= 0 {
+		cfg.Notifications.PollInterval = 2 * time.Second
+	}
+	if cfg.Notifications.MaxAttempts <= 0 {
+		cfg.Notifications.MaxAttempts = 8
+	}
+	if cfg.Notifications.Backoff <= 0 {
+		cfg.Notifications.Backoff = 10 * time.Second
+	}
+	if cfg.Notifications.MaxBackoff <= 0 {
+		cfg.Notifications.MaxBackoff = 30 * time.Minute
+	}
+	if cfg.Notifications.MaxBackoff < cfg.Notifications.Backoff {
+		cfg.Notifications.MaxBackoff = cfg.Notifications.Backoff
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = time.Minute
+	}
+
 	return &cfg, nil
 }
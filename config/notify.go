@@ -0,0 +1,146 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// FeishuTarget is the notify target name of the global Feishu bot, or of the
+// environment's when it overrides feishu
+const FeishuTarget = "feishu"
+
+// notifyStatuses are the run statuses notifications are sent for
+var notifyStatuses = []string{"started", "success", "failure", "timeout", "partial", "skipped", "cancelled", "interrupted"}
+
+// ValidateNotifyStatus checks that status is a run status notifications are sent for
+func ValidateNotifyStatus(status string) error {
+	if !containsFold(notifyStatuses, status) {
+		return errors.New("unknown status " + status + ", must be one of " + strings.Join(notifyStatuses, ", "))
+	}
+	return nil
+}
+
+// NotifyRouteConfig sends notifications of some statuses to named destinations
+// In config.yml a route is either a bare target name or an object with these fields
+type NotifyRouteConfig struct {
+	Targets  []string `mapstructure:"targets"`  // Names from notifiers, or feishu
+	Statuses []string `mapstructure:"statuses"` // Defaults to every status
+}
+
+// NotifyTargets returns the destinations of a notification about a run of the
+// project and environment with the given status
+func (cfg *Config) NotifyTargets(project, environment, status string) []NotifierConfig {
+	var targets []NotifierConfig
+	for _, name := range cfg.NotifyTargetNames(project, environment, status) {
+		if target, ok := cfg.NotifyTarget(project, environment, name); ok {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// NotifyTargetNames returns the names of the destinations of a notification
+// about a run of the project and environment with the given status. The routes
+// of the environment replace the project's; without routes notifications go to
+// the Feishu bot and the notifiers marked as default.
+func (cfg *Config) NotifyTargetNames(project, environment, status string) []string {
+	commands := cfg.Commands[project]
+	env := commands.Environments[environment]
+
+	routes := commands.Notify
+	if len(env.Notify) > 0 {
+		routes = env.Notify
+	}
+	var names []string
+	if len(routes) == 0 {
+		names = append(names, FeishuTarget)
+		for name, notifier := range cfg.Notifiers {
+			if notifier.Default {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names[1:])
+	}
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		if len(route.Statuses) > 0 && !containsFold(route.Statuses, status) {
+			continue
+		}
+		for _, name := range route.Targets {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// NotifyTarget resolves a destination name for a run of the project and
+// environment; feishu is the environment's Feishu bot when it overrides it
+func (cfg *Config) NotifyTarget(project, environment, name string) (NotifierConfig, bool) {
+	if name == FeishuTarget {
+		feishu := cfg.Feishu
+		if env := cfg.Commands[project].Environments[environment]; env.Feishu.Enabled() {
+			feishu = env.Feishu
+		}
+		return feishu.Notifier(), feishu.Enabled()
+	}
+	notifier, ok := cfg.Notifiers[name]
+	return notifier, ok
+}
+
+// validateNotifyRoutes checks that routes only name configured destinations and known statuses
+func validateNotifyRoutes(cfg *Config, prefix string, routes []NotifyRouteConfig, feishu FeishuConfig) error {
+	for _, route := range routes {
+		if len(route.Targets) == 0 {
+			return errors.New(prefix + ".notify entries must set targets")
+		}
+		for _, name := range route.Targets {
+			if name == FeishuTarget {
+				if !feishu.Enabled() && !cfg.Feishu.Enabled() {
+					return errors.New(prefix + ".notify refers to feishu but feishu is not configured")
+				}
+				continue
+			}
+			if _, ok := cfg.Notifiers[name]; !ok {
+				return errors.New(prefix + ".notify refers to unknown notifier " + name)
+			}
+		}
+		for _, status := range route.Statuses {
+			if !containsFold(notifyStatuses, status) {
+				return errors.New(prefix + ".notify has unknown status " + status)
+			}
+		}
+	}
+	return nil
+}
+
+// validateFeishu checks the app bot settings of a Feishu destination and
+// defaults its API base URL
+func validateFeishu(prefix string, feishu *FeishuConfig) error {
+	if feishu.AppID == "" {
+		return nil
+	}
+	if feishu.AppSecret == "" || feishu.ChatID == "" {
+		return errors.New(prefix + ".app_secret and " + prefix + ".chat_id must be set with app_id")
+	}
+	if feishu.APIURL == "" {
+		feishu.APIURL = defaultFeishuAPIURL
+	}
+	return nil
+}
+
+// stringToNotifyRouteHookFunc lets a route be written as a bare target name
+func stringToNotifyRouteHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(NotifyRouteConfig{}) {
+			return data, nil
+		}
+		return NotifyRouteConfig{Targets: []string{data.(string)}}, nil
+	}
+}
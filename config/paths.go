@@ -0,0 +1,42 @@
+package config
+
+// pathRules are the compiled paths and paths_ignore of a project
+type pathRules struct {
+	paths  []refRule
+	ignore []refRule
+}
+
+// compilePathRules compiles path filters, which take the same patterns as branches
+func compilePathRules(prefix string, paths, ignore []string) (pathRules, error) {
+	var rules pathRules
+	var err error
+	if len(paths) > 0 {
+		if rules.paths, err = compilePatterns(prefix+".paths", paths); err != nil {
+			return rules, err
+		}
+	}
+	if len(ignore) > 0 {
+		if rules.ignore, err = compilePatterns(prefix+".paths_ignore", ignore); err != nil {
+			return rules, err
+		}
+	}
+	return rules, nil
+}
+
+// MatchFiles reports whether a push changing the given files should run the project:
+// some file must not match paths_ignore and, if paths is set, match paths
+// A nil list means the changed files are unknown, which always runs
+func (c CommandsConfig) MatchFiles(files []string) bool {
+	if files == nil || (c.pathRules.paths == nil && c.pathRules.ignore == nil) {
+		return true
+	}
+	for _, file := range files {
+		if c.pathRules.ignore != nil && matchRules(c.pathRules.ignore, file) {
+			continue
+		}
+		if c.pathRules.paths == nil || matchRules(c.pathRules.paths, file) {
+			return true
+		}
+	}
+	return false
+}
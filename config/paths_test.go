@@ -0,0 +1,44 @@
+package config
+
+import "testing"
+
+func TestMatchFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		paths  []string
+		ignore []string
+		files  []string
+		want   bool
+	}{
+		{"no filters", nil, nil, []string{"main.go"}, true},
+		{"unknown files", []string{"backend/**"}, nil, nil, true},
+		{"no files changed", []string{"backend/**"}, nil, []string{}, false},
+		{"path matches", []string{"backend/**"}, nil, []string{"frontend/app.ts", "backend/api/main.go"}, true},
+		{"path does not match", []string{"backend/**"}, nil, []string{"frontend/app.ts"}, false},
+		{"only ignored files", nil, []string{"**/*.md"}, []string{"README.md", "docs/guide.md"}, false},
+		{"some file not ignored", nil, []string{"**/*.md"}, []string{"README.md", "main.go"}, true},
+		{"ignored file inside paths", []string{"backend/**"}, []string{"**/*.md"}, []string{"backend/README.md"}, false},
+		{"other file inside paths", []string{"backend/**"}, []string{"**/*.md"}, []string{"backend/README.md", "backend/main.go"}, true},
+		{"not ignored but outside paths", []string{"backend/**"}, []string{"**/*.md"}, []string{"frontend/app.ts"}, false},
+		{"exclude within paths", []string{"backend/**", "!backend/testdata/**"}, nil, []string{"backend/testdata/fixture.json"}, false},
+	}
+	for _, tt := range tests {
+		rules, err := compilePathRules("commands.app", tt.paths, tt.ignore)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		commands := CommandsConfig{pathRules: rules}
+		if got := commands.MatchFiles(tt.files); got != tt.want {
+			t.Errorf("%s: MatchFiles(%q) = %t, want %t", tt.name, tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePathRulesErrors(t *testing.T) {
+	if _, err := compilePathRules("commands.app", []string{"!docs/**"}, nil); err == nil {
+		t.Error("paths with only excludes compiled, want an error")
+	}
+	if _, err := compilePathRules("commands.app", nil, []string{"re:["}); err == nil {
+		t.Error("paths_ignore with an invalid regexp compiled, want an error")
+	}
+}
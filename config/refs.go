@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Kinds of git refs a project can be triggered by
+const (
+	RefBranch      = "branch"       // push to a branch
+	RefTag         = "tag"          // push of a tag
+	RefRelease     = "release"      // published GitHub release, matched by its tag
+	RefPullRequest = "pull_request" // pull request event, matched by its base branch
+)
+
+// refRule is a compiled entry of a branches, tags or releases list
+type refRule struct {
+	exclude bool
+	pattern *regexp.Regexp
+}
+
+// compilePatterns turns branch or tag patterns into rules
+// A pattern is an exact name, a glob where * matches within one path segment
+// and ** matches across segments, or a regular expression prefixed with re:.
+// Patterns starting with ! exclude names.
+func compilePatterns(prefix string, patterns []string) ([]refRule, error) {
+	rules := make([]refRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule := refRule{}
+		if strings.HasPrefix(pattern, "!") {
+			rule.exclude = true
+			pattern = strings.TrimPrefix(pattern, "!")
+		}
+		if pattern == "" {
+			return nil, errors.New(prefix + " entries must not be empty")
+		}
+
+		var expr string
+		if strings.HasPrefix(pattern, "re:") {
+			expr = strings.TrimPrefix(pattern, "re:")
+		} else {
+			expr = globToRegexp(pattern)
+		}
+		compiled, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.New(prefix + " has an invalid pattern " + pattern + ": " + err.Error())
+		}
+		rule.pattern = compiled
+		rules = append(rules, rule)
+	}
+
+	hasInclude := false
+	for _, rule := range rules {
+		if !rule.exclude {
+			hasInclude = true
+		}
+	}
+	if !hasInclude {
+		return nil, errors.New(prefix + " must include at least one name")
+	}
+	return rules, nil
+}
+
+// globToRegexp translates a glob into an anchored regular expression
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// Also matches no segment at all, so **/*.md matches README.md
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			sb.WriteString("[^/]*")
+		case glob[i] == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// matchRules reports whether a name matches any include rule and no exclude rule
+func matchRules(rules []refRule, name string) bool {
+	matched := false
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(name) {
+			continue
+		}
+		if rule.exclude {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// refRules holds the compiled branches, tags and releases patterns of a project or environment
+type refRules struct {
+	branches []refRule
+	tags     []refRule
+	releases []refRule
+}
+
+// compileRefRules compiles the branches, tags and releases patterns under prefix
+func compileRefRules(prefix string, branches, tags, releases []string) (refRules, error) {
+	var rules refRules
+	var err error
+	if len(branches) > 0 {
+		if rules.branches, err = compilePatterns(prefix+".branches", branches); err != nil {
+			return rules, err
+		}
+	}
+	if len(tags) > 0 {
+		if rules.tags, err = compilePatterns(prefix+".tags", tags); err != nil {
+			return rules, err
+		}
+	}
+	if len(releases) > 0 {
+		if rules.releases, err = compilePatterns(prefix+".releases", releases); err != nil {
+			return rules, err
+		}
+	}
+	return rules, nil
+}
+
+// match reports whether a ref of the given kind matches the rules
+func (r refRules) match(kind, name string) bool {
+	switch kind {
+	case RefBranch:
+		return matchRules(r.branches, name)
+	case RefTag:
+		return matchRules(r.tags, name)
+	case RefRelease:
+		return matchRules(r.releases, name)
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package config
+
+import "testing"
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		name string
+		want bool
+	}{
+		{"main", "main", true},
+		{"main", "main2", false},
+		{"main", "xmain", false},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release/1.0/hotfix", false},
+		{"release/*", "release/", true},
+		{"release/**", "release/1.0/hotfix", true},
+		{"release/**", "release", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/intro.md", true},
+		{"**/*.md", "docs/guide/intro.mdx", false},
+		{"v?.0", "v1.0", true},
+		{"v?.0", "v10.0", false},
+		{"v?.0", "v/.0", false},
+		{"v1.0", "v1x0", false},
+		{"feature+x", "feature+x", true},
+		{"**", "any/thing/at/all", true},
+	}
+	for _, tt := range tests {
+		rules, err := compilePatterns("branches", []string{tt.glob})
+		if err != nil {
+			t.Fatalf("compilePatterns(%q): %v", tt.glob, err)
+		}
+		if got := matchRules(rules, tt.name); got != tt.want {
+			t.Errorf("%q matching %q = %t, want %t (regexp %s)", tt.glob, tt.name, got, tt.want, globToRegexp(tt.glob))
+		}
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"release/*", "!release/old"}, "release/new", true},
+		{[]string{"release/*", "!release/old"}, "release/old", false},
+		// An exclude wins regardless of its position
+		{[]string{"!release/old", "release/*"}, "release/old", false},
+		{[]string{"main", "develop"}, "develop", true},
+		{[]string{"main", "develop"}, "feature", false},
+		{[]string{`re:^v\d+\.\d+\.\d+$`}, "v1.2.3", true},
+		{[]string{`re:^v\d+\.\d+\.\d+$`}, "v1.2", false},
+		// Regular expressions are not anchored unless they say so
+		{[]string{"re:hotfix"}, "release/hotfix-1", true},
+		{[]string{"v*", "!re:-rc\\d*$"}, "v1.0-rc1", false},
+		{[]string{"v*", "!re:-rc\\d*$"}, "v1.0", true},
+	}
+	for _, tt := range tests {
+		rules, err := compilePatterns("branches", tt.patterns)
+		if err != nil {
+			t.Fatalf("compilePatterns(%q): %v", tt.patterns, err)
+		}
+		if got := matchRules(rules, tt.name); got != tt.want {
+			t.Errorf("%q matching %q = %t, want %t", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePatternsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+	}{
+		{"empty pattern", []string{""}},
+		{"empty exclude", []string{"main", "!"}},
+		{"only excludes", []string{"!main", "!develop"}},
+		{"invalid regexp", []string{"re:("}},
+	}
+	for _, tt := range tests {
+		if _, err := compilePatterns("branches", tt.patterns); err == nil {
+			t.Errorf("%s: compilePatterns(%q) succeeded, want an error", tt.name, tt.patterns)
+		}
+	}
+}
+
+func TestRefRulesMatch(t *testing.T) {
+	rules, err := compileRefRules("commands.app", []string{"main"}, []string{"v*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		kind string
+		name string
+		want bool
+	}{
+		{RefBranch, "main", true},
+		{RefBranch, "v1", false},
+		{RefTag, "v1", true},
+		{RefTag, "main", false},
+		// Releases only run when releases are configured
+		{RefRelease, "v1", false},
+		{RefPullRequest, "main", false},
+	}
+	for _, tt := range tests {
+		if got := rules.match(tt.kind, tt.name); got != tt.want {
+			t.Errorf("match(%s, %q) = %t, want %t", tt.kind, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCommandsConfigMatchEnvironments(t *testing.T) {
+	compile := func(branches ...string) EnvironmentConfig {
+		rules, err := compileRefRules("commands.app.environments", branches, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return EnvironmentConfig{refRules: rules}
+	}
+	commands := CommandsConfig{Environments: map[string]EnvironmentConfig{
+		"production": compile("main"),
+		"staging":    compile("main", "develop"),
+		"preview":    compile("feature/**"),
+	}}
+
+	tests := []struct {
+		branch      string
+		environment string
+		ok          bool
+	}{
+		// Environments are tried in name order, so production wins over staging
+		{"main", "production", true},
+		{"develop", "staging", true},
+		{"feature/a/b", "preview", true},
+		{"hotfix", "", false},
+	}
+	for _, tt := range tests {
+		environment, ok := commands.Match(RefBranch, tt.branch)
+		if environment != tt.environment || ok != tt.ok {
+			t.Errorf("Match(%q) = %q, %t, want %q, %t", tt.branch, environment, ok, tt.environment, tt.ok)
+		}
+	}
+}
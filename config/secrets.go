@@ -0,0 +1,86 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// WebhookSecretConfig is a webhook secret, plus the secret it replaces while a rotation is in progress
+// It can be written as a bare string when no rotation is going on
+type WebhookSecretConfig struct {
+	Secret            string    `mapstructure:"secret"`
+	PreviousSecret    string    `mapstructure:"previous_secret"`     // Still accepted until previous_expires_at
+	PreviousExpiresAt time.Time `mapstructure:"previous_expires_at"` // RFC 3339, e.g. 2026-11-01T00:00:00Z
+}
+
+// Accepted returns the secrets a webhook may be signed with at the given time, current secret first
+func (w WebhookSecretConfig) Accepted(now time.Time) []string {
+	if w.Secret == "" {
+		return nil
+	}
+	secrets := []string{w.Secret}
+	if w.PreviousSecret != "" && now.Before(w.PreviousExpiresAt) {
+		secrets = append(secrets, w.PreviousSecret)
+	}
+	return secrets
+}
+
+// WebhookSecrets returns the secrets accepted for webhooks of a repository:
+// those set on its projects, else the one of its organization, else github_webhook_secret
+func (cfg *Config) WebhookSecrets(orgName, repoName string, now time.Time) []string {
+	var secrets []string
+	for _, commands := range cfg.Commands {
+		if commands.Organization == orgName && commands.Repo == repoName {
+			secrets = append(secrets, commands.WebhookSecret.Accepted(now)...)
+		}
+	}
+	if len(secrets) > 0 {
+		return secrets
+	}
+	// Viper lowercases map keys, GitHub organization names are case-insensitive anyway
+	if organization, ok := cfg.WebhookSecretsByOrg[strings.ToLower(orgName)]; ok {
+		return organization.Accepted(now)
+	}
+	return cfg.GitHubWebhookSecret.Accepted(now)
+}
+
+// hasWebhookSecret reports whether any webhook secret is configured
+func (cfg *Config) hasWebhookSecret() bool {
+	if cfg.GitHubWebhookSecret.Secret != "" || len(cfg.WebhookSecretsByOrg) > 0 {
+		return true
+	}
+	for _, commands := range cfg.Commands {
+		if commands.WebhookSecret.Secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhookSecret checks a webhook secret and its rotation settings
+func validateWebhookSecret(field string, w WebhookSecretConfig) error {
+	if w.PreviousSecret == "" {
+		return nil
+	}
+	if w.Secret == "" {
+		return errors.New(field + ".secret must be set with previous_secret")
+	}
+	if w.PreviousExpiresAt.IsZero() {
+		return errors.New(field + ".previous_expires_at must be set with previous_secret")
+	}
+	return nil
+}
+
+// stringToWebhookSecretHookFunc lets a webhook secret be written as a bare string
+func stringToWebhookSecretHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(WebhookSecretConfig{}) {
+			return data, nil
+		}
+		return WebhookSecretConfig{Secret: data.(string)}, nil
+	}
+}
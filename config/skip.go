@@ -0,0 +1,64 @@
+package config
+
+import "strings"
+
+// defaultSkipMarkers are the commit message markers that skip a push unless a project sets its own
+var defaultSkipMarkers = []string{"[skip sentry]", "[sentry skip]", "[skip deploy]", "[deploy skip]"}
+
+// ActorsConfig limits who can trigger runs by GitHub login: the pusher of a push
+// and the sender of any webhook, usually the same user
+type ActorsConfig struct {
+	Allow []string `mapstructure:"allow"` // Only these logins trigger runs, empty allows everyone not denied
+	Deny  []string `mapstructure:"deny"`  // These logins never trigger runs, e.g. dependabot[bot]
+}
+
+// check returns why the actors may not trigger a run, or an empty string if they may
+// Logins are compared case-insensitively, empty ones are ignored
+func (a ActorsConfig) check(actors []string) string {
+	for _, actor := range actors {
+		if actor == "" {
+			continue
+		}
+		if containsFold(a.Deny, actor) {
+			return actor + " is denied"
+		}
+		if len(a.Allow) > 0 && !containsFold(a.Allow, actor) {
+			return actor + " is not allowed"
+		}
+	}
+	return ""
+}
+
+// SkipReason returns why a run of the project, and of the environment if not
+// empty, should be recorded as skipped instead of executed, or an empty string
+// Skip markers only apply to the commit message of pushes, the actors are the
+// pusher and sender logins of the webhook
+func (c CommandsConfig) SkipReason(environment, refType, message string, actors ...string) string {
+	if refType == RefBranch || refType == RefTag {
+		lower := strings.ToLower(message)
+		for _, marker := range c.SkipMarkers {
+			if strings.Contains(lower, strings.ToLower(marker)) {
+				return "commit message contains " + marker
+			}
+		}
+	}
+	if reason := c.Actors.check(actors); reason != "" {
+		return reason
+	}
+	if env, ok := c.Environments[environment]; ok && refType != RefPullRequest {
+		if reason := env.Actors.check(actors); reason != "" {
+			return reason + " to deploy " + environment
+		}
+	}
+	return ""
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -36,10 +38,14 @@ func InitDB(cfg *config.Config) error {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	if err := migrateTables(); err != nil {
+		return fmt.Errorf("failed to migrate tables: %w", err)
+	}
+
 	return nil
 }
 
-// createTables creates the triggers and executions tables
+// createTables creates the triggers, executions, execution_logs, jobs and deliveries tables
 func createTables() error {
 	triggersTable := `
 	CREATE TABLE IF NOT EXISTS triggers (
@@ -66,10 +72,85 @@ func createTables() error {
 		return fmt.Errorf("failed to create triggers table: %w", err)
 	}
 
+	executionLogsTable := `
+	CREATE TABLE IF NOT EXISTS execution_logs (
+		id BIGSERIAL PRIMARY KEY,
+		trigger_id INTEGER NOT NULL REFERENCES triggers(id) ON DELETE CASCADE,
+		content TEXT NOT NULL,
+		line_count INTEGER NOT NULL,
+		first_line_at TIMESTAMP NOT NULL,
+		last_line_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS execution_logs_trigger_id_idx ON execution_logs (trigger_id, id);`
+
 	if _, err := db.Exec(executionsTable); err != nil {
 		return fmt.Errorf("failed to create executions table: %w", err)
 	}
 
+	if _, err := db.Exec(executionLogsTable); err != nil {
+		return fmt.Errorf("failed to create execution_logs table: %w", err)
+	}
+
+	if err := createJobsTable(); err != nil {
+		return err
+	}
+
+	if err := createDeliveriesTable(); err != nil {
+		return err
+	}
+
+	if err := createNotificationsTable(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrations add columns introduced after the initial schema
+// Every statement must be idempotent since they run on each startup
+var migrations = []string{
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS step_name VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS working_dir TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS allow_failure BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS finished_at TIMESTAMP`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS exit_code INTEGER`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS signal VARCHAR(32) NOT NULL DEFAULT ''`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS stdout TEXT`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS stderr TEXT`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS project VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS environment VARCHAR(255) NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS triggers_project_environment_idx ON triggers (project, environment, id)`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS environment VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS ref_type VARCHAR(20) NOT NULL DEFAULT 'branch'`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS tag VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS release_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS pr_number INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS pr_title TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS pr_action VARCHAR(32) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS pr_author VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS base_ref VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS head_ref VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS check_run_id BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS delivery_id VARCHAR(64) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS hook_id VARCHAR(32) NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS forced BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS triggers_delivery_idx ON triggers (delivery_id, project, environment) WHERE delivery_id <> '' AND NOT forced`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS skip_reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE triggers ADD COLUMN IF NOT EXISTS changed_files JSONB`,
+	`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS external_id VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS run_attempt INTEGER NOT NULL DEFAULT 1`,
+}
+
+// migrateTables applies schema changes to existing tables
+func migrateTables() error {
+	for _, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil {
+			return fmt.Errorf("failed to run migration %q: %w", migration, err)
+		}
+	}
 	return nil
 }
 
@@ -78,25 +159,95 @@ func GetDB() *sql.DB {
 	return db
 }
 
+// Trigger statuses, the final ones match the aggregate run statuses of the executor
+const (
+	TriggerQueued      = "queued"
+	TriggerRunning     = "running"
+	TriggerSuccess     = "success"
+	TriggerPartial     = "partial"
+	TriggerFailed      = "failed"
+	TriggerSkipped     = "skipped"
+	TriggerCancelled   = "cancelled"
+	TriggerInterrupted = "interrupted"
+)
+
 // Trigger represents a webhook trigger record
 type Trigger struct {
 	ID            int64
 	Time          time.Time
 	CommitID      string
 	CommitMessage string
-	Branch        string
+	Branch        string // empty for tag pushes and releases, the head branch for pull requests
+	RefType       string // branch, tag, release or pull_request
+	Tag           string
+	ReleaseName   string
+	PRNumber      int // 0 unless the trigger is a pull request
+	PRTitle       string
+	PRAction      string
+	PRAuthor      string
+	BaseRef       string
+	HeadRef       string
+	Project       string // empty when no project matched
+	Environment   string // empty for projects without environments
+	CheckRunID    int64  // GitHub check run reporting the trigger's run, 0 if none
+	DeliveryID    string // X-GitHub-Delivery of the webhook, empty if unknown
+	HookID        string // X-GitHub-Hook-ID of the webhook
+	Forced        bool   // recorded even though the delivery was seen before
+	Status        string
+	SkipReason    string   // why the run was skipped, empty unless Status is skipped
+	ChangedFiles  []string // files changed by a branch push, nil if unknown
+	FinishedAt    *time.Time
 	CreatedAt     time.Time
 }
 
-// RecordTrigger records a new trigger in the database
-func RecordTrigger(time time.Time, commitID, commitMessage, branch string) (int64, error) {
+// ErrDuplicateDelivery is returned by RecordTrigger for a webhook delivery that
+// was already recorded for the same project and environment
+var ErrDuplicateDelivery = errors.New("duplicate delivery")
+
+// RecordTrigger records a new trigger in the database with status queued
+// Unless the trigger is forced, a delivery id is only recorded once per project
+// and environment and later attempts return ErrDuplicateDelivery
+func RecordTrigger(trigger Trigger) (int64, error) {
 	query := `
-		INSERT INTO triggers (time, commit_id, commit_message, branch)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO triggers (time, commit_id, commit_message, branch, ref_type, tag, release_name, pr_number, pr_title, pr_action, pr_author, base_ref, head_ref, project, environment, delivery_id, hook_id, forced, changed_files, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+		ON CONFLICT (delivery_id, project, environment) WHERE delivery_id <> '' AND NOT forced DO NOTHING
 		RETURNING id`
 
+	var changedFiles []byte
+	if trigger.ChangedFiles != nil {
+		var err error
+		if changedFiles, err = json.Marshal(trigger.ChangedFiles); err != nil {
+			return 0, fmt.Errorf("failed to encode changed files: %w", err)
+		}
+	}
+
 	var id int64
-	err := db.QueryRow(query, time, commitID, commitMessage, branch).Scan(&id)
+	err := db.QueryRow(query,
+		trigger.Time,
+		trigger.CommitID,
+		trigger.CommitMessage,
+		trigger.Branch,
+		trigger.RefType,
+		trigger.Tag,
+		trigger.ReleaseName,
+		trigger.PRNumber,
+		trigger.PRTitle,
+		trigger.PRAction,
+		trigger.PRAuthor,
+		trigger.BaseRef,
+		trigger.HeadRef,
+		trigger.Project,
+		trigger.Environment,
+		trigger.DeliveryID,
+		trigger.HookID,
+		trigger.Forced,
+		changedFiles,
+		TriggerQueued,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrDuplicateDelivery
+	}
 	if err != nil {
 		return 0, fmt.Errorf("failed to record trigger: %w", err)
 	}
@@ -104,24 +255,200 @@ func RecordTrigger(time time.Time, commitID, commitMessage, branch string) (int6
 	return id, nil
 }
 
+// Finished reports whether the trigger's run has ended
+func (t *Trigger) Finished() bool {
+	return t.Status != TriggerQueued && t.Status != TriggerRunning
+}
+
+// GetTrigger returns the trigger with the given id, or sql.ErrNoRows if there is none
+func GetTrigger(triggerID int64) (*Trigger, error) {
+	query := `
+		SELECT ` + triggerColumns + `
+		FROM triggers
+		WHERE id = $1`
+
+	trigger, err := scanTrigger(db.QueryRow(query, triggerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trigger %d: %w", triggerID, err)
+	}
+
+	return trigger, nil
+}
+
+// triggerColumns lists the columns read by scanTrigger, in order
+const triggerColumns = `id, time, commit_id, commit_message, branch, ref_type, tag, release_name,
+	pr_number, pr_title, pr_action, pr_author, base_ref, head_ref, project, environment, check_run_id,
+	delivery_id, hook_id, forced, status, skip_reason, changed_files, finished_at, created_at`
+
+// scanTrigger reads a trigger row selected with triggerColumns
+func scanTrigger(row interface{ Scan(...interface{}) error }) (*Trigger, error) {
+	var trigger Trigger
+	var finishedAt sql.NullTime
+	var changedFiles []byte
+	err := row.Scan(
+		&trigger.ID,
+		&trigger.Time,
+		&trigger.CommitID,
+		&trigger.CommitMessage,
+		&trigger.Branch,
+		&trigger.RefType,
+		&trigger.Tag,
+		&trigger.ReleaseName,
+		&trigger.PRNumber,
+		&trigger.PRTitle,
+		&trigger.PRAction,
+		&trigger.PRAuthor,
+		&trigger.BaseRef,
+		&trigger.HeadRef,
+		&trigger.Project,
+		&trigger.Environment,
+		&trigger.CheckRunID,
+		&trigger.DeliveryID,
+		&trigger.HookID,
+		&trigger.Forced,
+		&trigger.Status,
+		&trigger.SkipReason,
+		&changedFiles,
+		&finishedAt,
+		&trigger.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if finishedAt.Valid {
+		trigger.FinishedAt = &finishedAt.Time
+	}
+	if changedFiles != nil {
+		if err := json.Unmarshal(changedFiles, &trigger.ChangedFiles); err != nil {
+			return nil, fmt.Errorf("failed to decode changed files: %w", err)
+		}
+	}
+	return &trigger, nil
+}
+
+// ListTriggers returns the most recent triggers, newest first
+// Empty project or environment values do not filter
+func ListTriggers(project, environment string, limit int) ([]*Trigger, error) {
+	query := `
+		SELECT ` + triggerColumns + `
+		FROM triggers
+		WHERE ($1 = '' OR project = $1) AND ($2 = '' OR environment = $2)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	rows, err := db.Query(query, project, environment, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list triggers: %w", err)
+	}
+	defer rows.Close()
+
+	triggers := make([]*Trigger, 0)
+	for rows.Next() {
+		trigger, err := scanTrigger(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan trigger: %w", err)
+		}
+		triggers = append(triggers, trigger)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list triggers: %w", err)
+	}
+
+	return triggers, nil
+}
+
+// SetTriggerStatus updates the status of a trigger whose run has not finished yet
+func SetTriggerStatus(triggerID int64, status string) error {
+	query := `UPDATE triggers SET status = $2 WHERE id = $1`
+
+	if _, err := db.Exec(query, triggerID, status); err != nil {
+		return fmt.Errorf("failed to set trigger status: %w", err)
+	}
+
+	return nil
+}
+
+// SetCheckRunID records the GitHub check run that reports a trigger's run
+func SetCheckRunID(triggerID, checkRunID int64) error {
+	query := `UPDATE triggers SET check_run_id = $2 WHERE id = $1`
+
+	if _, err := db.Exec(query, triggerID, checkRunID); err != nil {
+		return fmt.Errorf("failed to set check run id: %w", err)
+	}
+
+	return nil
+}
+
+// FinishTrigger records the final status of a trigger's run
+func FinishTrigger(triggerID int64, status string) error {
+	query := `
+		UPDATE triggers SET status = $2, finished_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+
+	if _, err := db.Exec(query, triggerID, status); err != nil {
+		return fmt.Errorf("failed to finish trigger: %w", err)
+	}
+
+	return nil
+}
+
+// SkipTrigger records that a trigger's run was skipped and why
+func SkipTrigger(triggerID int64, reason string) error {
+	query := `
+		UPDATE triggers SET status = $2, skip_reason = $3, finished_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+
+	if _, err := db.Exec(query, triggerID, TriggerSkipped, reason); err != nil {
+		return fmt.Errorf("failed to skip trigger: %w", err)
+	}
+
+	return nil
+}
+
 // Execution represents a script execution record
 type Execution struct {
-	ID        int64
-	TriggerID int64
-	ScriptName string
-	Status    string
-	Output    string
-	Error     string
-	ExecutedAt time.Time
+	ID           int64
+	TriggerID    int64
+	ScriptName   string
+	StepName     string
+	Environment  string
+	WorkingDir   string
+	Status       string
+	Output       string
+	Stdout       string
+	Stderr       string
+	ExitCode     *int // nil when the command did not exit normally
+	Signal       string
+	Error        string
+	Attempts     int
+	AllowFailure bool
+	RunAttempt   int // attempt of the run that executed the step, above 1 when it was requeued
+	ExecutedAt   time.Time
 }
 
 // RecordExecution records a script execution in the database
-func RecordExecution(triggerID int64, scriptName, status, output, errorMsg string) error {
+func RecordExecution(execution Execution) error {
 	query := `
-		INSERT INTO executions (trigger_id, script_name, status, output, error)
-		VALUES ($1, $2, $3, $4, $5)`
+		INSERT INTO executions (trigger_id, script_name, step_name, environment, working_dir, status, output, stdout, stderr, exit_code, signal, error, attempts, allow_failure, run_attempt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`
 
-	_, err := db.Exec(query, triggerID, scriptName, status, output, errorMsg)
+	_, err := db.Exec(query,
+		execution.TriggerID,
+		execution.ScriptName,
+		execution.StepName,
+		execution.Environment,
+		execution.WorkingDir,
+		execution.Status,
+		execution.Output,
+		execution.Stdout,
+		execution.Stderr,
+		execution.ExitCode,
+		execution.Signal,
+		execution.Error,
+		execution.Attempts,
+		execution.AllowFailure,
+		execution.RunAttempt,
+	)
 	if err != nil {
 		return fmt.Errorf("failed to record execution: %w", err)
 	}
@@ -129,6 +456,116 @@ func RecordExecution(triggerID int64, scriptName, status, output, errorMsg strin
 	return nil
 }
 
+// GetExecutions returns the recorded steps of a trigger's run in execution order
+// Steps of earlier attempts of a requeued run are superseded by the last attempt and left out
+func GetExecutions(triggerID int64) ([]Execution, error) {
+	query := `
+		SELECT id, trigger_id, script_name, step_name, environment, working_dir, status, COALESCE(output, ''),
+			COALESCE(stdout, ''), COALESCE(stderr, ''), exit_code, signal, COALESCE(error, ''), attempts, allow_failure, run_attempt, executed_at
+		FROM executions
+		WHERE trigger_id = $1
+		AND run_attempt = (SELECT MAX(run_attempt) FROM executions WHERE trigger_id = $1)
+		ORDER BY id`
+
+	rows, err := db.Query(query, triggerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get executions: %w", err)
+	}
+	defer rows.Close()
+
+	executions := make([]Execution, 0)
+	for rows.Next() {
+		var execution Execution
+		var exitCode sql.NullInt64
+		if err := rows.Scan(
+			&execution.ID,
+			&execution.TriggerID,
+			&execution.ScriptName,
+			&execution.StepName,
+			&execution.Environment,
+			&execution.WorkingDir,
+			&execution.Status,
+			&execution.Output,
+			&execution.Stdout,
+			&execution.Stderr,
+			&exitCode,
+			&execution.Signal,
+			&execution.Error,
+			&execution.Attempts,
+			&execution.AllowFailure,
+			&execution.RunAttempt,
+			&execution.ExecutedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan execution: %w", err)
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			execution.ExitCode = &code
+		}
+		executions = append(executions, execution)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get executions: %w", err)
+	}
+
+	return executions, nil
+}
+
+// LogChunk is a batch of timestamped output lines of a run
+// IDs increase in insertion order, so they double as a cursor for tailing
+type LogChunk struct {
+	ID          int64
+	TriggerID   int64
+	Content     string
+	LineCount   int
+	FirstLineAt time.Time
+	LastLineAt  time.Time
+}
+
+// AppendLogChunk stores a batch of output lines for a trigger
+func AppendLogChunk(chunk LogChunk) error {
+	query := `
+		INSERT INTO execution_logs (trigger_id, content, line_count, first_line_at, last_line_at)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := db.Exec(query, chunk.TriggerID, chunk.Content, chunk.LineCount, chunk.FirstLineAt, chunk.LastLineAt)
+	if err != nil {
+		return fmt.Errorf("failed to append log chunk: %w", err)
+	}
+
+	return nil
+}
+
+// GetLogChunks returns up to limit log chunks of a trigger with an id greater than afterID
+func GetLogChunks(triggerID, afterID int64, limit int) ([]LogChunk, error) {
+	query := `
+		SELECT id, trigger_id, content, line_count, first_line_at, last_line_at
+		FROM execution_logs
+		WHERE trigger_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`
+
+	rows, err := db.Query(query, triggerID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get log chunks: %w", err)
+	}
+	defer rows.Close()
+
+	chunks := make([]LogChunk, 0)
+	for rows.Next() {
+		var chunk LogChunk
+		if err := rows.Scan(&chunk.ID, &chunk.TriggerID, &chunk.Content, &chunk.LineCount, &chunk.FirstLineAt, &chunk.LastLineAt); err != nil {
+			return nil, fmt.Errorf("failed to scan log chunk: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read log chunks: %w", err)
+	}
+
+	return chunks, nil
+}
+
 // Close closes the database connection
 func Close() error {
 	if db != nil {
@@ -136,4 +573,3 @@ func Close() error {
 	}
 	return nil
 }
-
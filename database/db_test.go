@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB connects to the database in DATABASE_URL, creates the tables and
+// empties them; tests that need Postgres are skipped when it is not set
+// DATABASE_URL must point at a scratch database, its rows are deleted
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	var err error
+	if db, err = sql.Open("postgres", dsn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+	})
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTables(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateTables(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`TRUNCATE triggers, executions, execution_logs, jobs, job_groups, deliveries, notifications RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestTrigger records a queued trigger for jobs to refer to
+func newTestTrigger(t *testing.T) int64 {
+	t.Helper()
+	id, err := RecordTrigger(Trigger{
+		Time:          time.Now(),
+		CommitID:      "0123abcd",
+		CommitMessage: "test",
+		Branch:        "main",
+		RefType:       "branch",
+		Project:       "app",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestRecordTriggerDeduplicatesDeliveries(t *testing.T) {
+	openTestDB(t)
+
+	delivery := func(deliveryID, environment string, forced bool) Trigger {
+		return Trigger{
+			Time:        time.Now(),
+			CommitID:    "0123abcd",
+			Branch:      "main",
+			RefType:     "branch",
+			Project:     "app",
+			Environment: environment,
+			DeliveryID:  deliveryID,
+			Forced:      forced,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		trigger Trigger
+		wantDup bool
+	}{
+		{"first delivery", delivery("d-1", "staging", false), false},
+		{"redelivery", delivery("d-1", "staging", false), true},
+		{"same delivery for another environment", delivery("d-1", "production", false), false},
+		{"forced replay", delivery("d-1", "staging", true), false},
+		{"second forced replay", delivery("d-1", "staging", true), false},
+		{"redelivery after a replay", delivery("d-1", "staging", false), true},
+		{"unknown delivery id", delivery("", "staging", false), false},
+		{"another unknown delivery id", delivery("", "staging", false), false},
+	}
+	for _, tt := range tests {
+		id, err := RecordTrigger(tt.trigger)
+		if tt.wantDup {
+			if !errors.Is(err, ErrDuplicateDelivery) {
+				t.Errorf("%s: got id %d, error %v, want ErrDuplicateDelivery", tt.name, id, err)
+			}
+			continue
+		}
+		if err != nil || id == 0 {
+			t.Errorf("%s: got id %d, error %v, want a new trigger", tt.name, id, err)
+			continue
+		}
+		trigger, err := GetTrigger(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trigger.DeliveryID != tt.trigger.DeliveryID || trigger.Forced != tt.trigger.Forced {
+			t.Errorf("%s: recorded delivery %q forced %t", tt.name, trigger.DeliveryID, trigger.Forced)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM triggers WHERE delivery_id = 'd-1'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("recorded %d triggers for delivery d-1, want 4", count)
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Delivery is a validated webhook request as GitHub sent it
+// Every receipt is archived, so a redelivered id can have several rows
+type Delivery struct {
+	ID         int64
+	DeliveryID string
+	HookID     string
+	Event      string
+	Headers    http.Header
+	Payload    []byte
+	ReceivedAt time.Time
+}
+
+// createDeliveriesTable creates the archive of raw webhook deliveries
+func createDeliveriesTable() error {
+	deliveriesTable := `
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		delivery_id VARCHAR(64) NOT NULL,
+		hook_id VARCHAR(32) NOT NULL DEFAULT '',
+		event VARCHAR(64) NOT NULL,
+		headers JSONB NOT NULL,
+		payload TEXT NOT NULL,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS deliveries_delivery_id_idx ON deliveries (delivery_id, id);`
+
+	if _, err := db.Exec(deliveriesTable); err != nil {
+		return fmt.Errorf("failed to create deliveries table: %w", err)
+	}
+
+	return nil
+}
+
+// ArchiveDelivery stores a webhook request and returns its row id
+func ArchiveDelivery(delivery Delivery) (int64, error) {
+	headers, err := json.Marshal(delivery.Headers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode delivery headers: %w", err)
+	}
+
+	query := `
+		INSERT INTO deliveries (delivery_id, hook_id, event, headers, payload)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+
+	var id int64
+	if err := db.QueryRow(query, delivery.DeliveryID, delivery.HookID, delivery.Event, headers, string(delivery.Payload)).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to archive delivery: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetDelivery returns the latest archived receipt of a delivery id, or sql.ErrNoRows if there is none
+func GetDelivery(deliveryID string) (*Delivery, error) {
+	query := `
+		SELECT id, delivery_id, hook_id, event, headers, payload, received_at
+		FROM deliveries
+		WHERE delivery_id = $1
+		ORDER BY id DESC
+		LIMIT 1`
+
+	var delivery Delivery
+	var headers []byte
+	var payload string
+	err := db.QueryRow(query, deliveryID).Scan(
+		&delivery.ID,
+		&delivery.DeliveryID,
+		&delivery.HookID,
+		&delivery.Event,
+		&headers,
+		&payload,
+		&delivery.ReceivedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get delivery %s: %w", deliveryID, err)
+	}
+	if err := json.Unmarshal(headers, &delivery.Headers); err != nil {
+		return nil, fmt.Errorf("failed to decode delivery headers: %w", err)
+	}
+	delivery.Payload = []byte(payload)
+
+	return &delivery, nil
+}
@@ -0,0 +1,304 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job statuses
+const (
+	JobQueued      = "queued"
+	JobRunning     = "running"
+	JobDone        = "done"
+	JobSkipped     = "skipped"
+	JobCancelled   = "cancelled"
+	JobInterrupted = "interrupted"
+)
+
+// Job is a queued run of a trigger
+// Payload holds whatever the run needs to start, encoded by the caller
+type Job struct {
+	ID               int64
+	TriggerID        int64
+	ConcurrencyGroup string
+	Policy           string
+	Status           string
+	Payload          []byte
+	Attempts         int // claims of the run so far, including those of jobs it was requeued from
+	Error            string
+	Worker           string
+	CancelReason     string // set when another run asked for the job to be cancelled
+	CreatedAt        time.Time
+	ClaimedAt        *time.Time
+	FinishedAt       *time.Time
+}
+
+// createJobsTable creates the jobs table used as a durable run queue, and the
+// job_groups table whose rows are locked to claim the jobs of a concurrency group
+func createJobsTable() error {
+	jobsTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id BIGSERIAL PRIMARY KEY,
+		trigger_id INTEGER NOT NULL REFERENCES triggers(id) ON DELETE CASCADE,
+		concurrency_group VARCHAR(255) NOT NULL,
+		policy VARCHAR(32) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		payload JSONB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		worker VARCHAR(255) NOT NULL DEFAULT '',
+		cancel_reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		claimed_at TIMESTAMP,
+		finished_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, id);
+	CREATE INDEX IF NOT EXISTS jobs_group_status_idx ON jobs (concurrency_group, status);
+	CREATE TABLE IF NOT EXISTS job_groups (
+		name VARCHAR(255) PRIMARY KEY
+	);`
+
+	if _, err := db.Exec(jobsTable); err != nil {
+		return fmt.Errorf("failed to create jobs table: %w", err)
+	}
+
+	return nil
+}
+
+const jobColumns = `id, trigger_id, concurrency_group, policy, status, payload, attempts, error, worker, cancel_reason, created_at, claimed_at, finished_at`
+
+// scanJob reads a row selected with jobColumns
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var claimedAt, finishedAt sql.NullTime
+	err := row.Scan(
+		&job.ID,
+		&job.TriggerID,
+		&job.ConcurrencyGroup,
+		&job.Policy,
+		&job.Status,
+		&job.Payload,
+		&job.Attempts,
+		&job.Error,
+		&job.Worker,
+		&job.CancelReason,
+		&job.CreatedAt,
+		&claimedAt,
+		&finishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claimedAt.Valid {
+		job.ClaimedAt = &claimedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return &job, nil
+}
+
+// scanJobs reads every row selected with jobColumns
+func scanJobs(rows *sql.Rows) ([]*Job, error) {
+	defer rows.Close()
+
+	jobs := make([]*Job, 0)
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// EnqueueJob adds a queued job for a trigger
+// When supersede is set, queued jobs of the same concurrency group are marked
+// skipped in the same transaction and returned, so the caller can report them
+func EnqueueJob(triggerID int64, group, policy string, payload []byte, supersede bool, reason string) (int64, []*Job, error) {
+	return enqueueJob(triggerID, group, policy, payload, 0, supersede, reason)
+}
+
+// enqueueJob adds a queued job that already made the given number of attempts
+func enqueueJob(triggerID int64, group, policy string, payload []byte, attempts int, supersede bool, reason string) (int64, []*Job, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	superseded := make([]*Job, 0)
+	if supersede {
+		rows, err := tx.Query(`
+			UPDATE jobs SET status = $2, error = $3, finished_at = CURRENT_TIMESTAMP
+			WHERE concurrency_group = $1 AND status = $4
+			RETURNING `+jobColumns,
+			group, JobSkipped, reason, JobQueued)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to supersede queued jobs: %w", err)
+		}
+		if superseded, err = scanJobs(rows); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`INSERT INTO job_groups (name) VALUES ($1) ON CONFLICT DO NOTHING`, group); err != nil {
+		return 0, nil, fmt.Errorf("failed to record concurrency group: %w", err)
+	}
+
+	var id int64
+	err = tx.QueryRow(`
+		INSERT INTO jobs (trigger_id, concurrency_group, policy, status, payload, attempts)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		triggerID, group, policy, JobQueued, payload, attempts).Scan(&id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("failed to commit job: %w", err)
+	}
+
+	return id, superseded, nil
+}
+
+// ClaimJob marks the oldest queued job whose concurrency group has no running
+// job as running by worker and returns it, or returns nil when there is none
+// The group's row in job_groups is locked with FOR UPDATE SKIP LOCKED for the
+// claim, so concurrent claimers skip a group instead of both starting one of
+// its jobs; the running check is repeated once the lock is held, because under
+// READ COMMITTED only a statement started after the lock sees the last claim
+func ClaimJob(worker string) (*Job, error) {
+	for {
+		job, claimed, err := claimNextGroup(worker)
+		if err != nil || claimed {
+			return job, err
+		}
+	}
+}
+
+// claimNextGroup locks the idle group with the oldest queued job and claims that job
+// claimed is false when the group got a running job before it was locked, the
+// caller then looks again; a nil job with claimed set means nothing is runnable
+func claimNextGroup(worker string) (job *Job, claimed bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var group string
+	err = tx.QueryRow(`
+		SELECT g.name FROM job_groups g
+		WHERE EXISTS (
+			SELECT 1 FROM jobs q WHERE q.concurrency_group = g.name AND q.status = $1
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM jobs r WHERE r.concurrency_group = g.name AND r.status = $2
+		)
+		ORDER BY (SELECT MIN(q.id) FROM jobs q WHERE q.concurrency_group = g.name AND q.status = $1)
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`,
+		JobQueued, JobRunning).Scan(&group)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lock concurrency group: %w", err)
+	}
+
+	query := `
+		UPDATE jobs SET status = $1, worker = $2, attempts = attempts + 1, claimed_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT j.id FROM jobs j
+			WHERE j.concurrency_group = $3 AND j.status = $4
+			AND NOT EXISTS (
+				SELECT 1 FROM jobs r
+				WHERE r.concurrency_group = $3 AND r.status = $1
+			)
+			ORDER BY j.id
+			LIMIT 1
+		)
+		RETURNING ` + jobColumns
+
+	job, err = scanJob(tx.QueryRow(query, JobRunning, worker, group, JobQueued))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim job: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit claim: %w", err)
+	}
+
+	return job, true, nil
+}
+
+// RequestCancel asks the workers running jobs of a concurrency group to cancel
+// them and returns those jobs
+// The reason is stored on the job, so workers of other instances pick it up
+// through CancelRequestedJobs on their next poll
+func RequestCancel(group, reason string) ([]*Job, error) {
+	rows, err := db.Query(`
+		UPDATE jobs SET cancel_reason = $3
+		WHERE concurrency_group = $1 AND status = $2
+		RETURNING `+jobColumns,
+		group, JobRunning, reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request cancellation of running jobs: %w", err)
+	}
+	return scanJobs(rows)
+}
+
+// CancelRequestedJobs returns the running jobs of worker that were asked to cancel
+func CancelRequestedJobs(worker string) ([]*Job, error) {
+	rows, err := db.Query(`SELECT `+jobColumns+` FROM jobs WHERE worker = $1 AND status = $2 AND cancel_reason <> '' ORDER BY id`, worker, JobRunning)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cancelled jobs: %w", err)
+	}
+	return scanJobs(rows)
+}
+
+// FinishJob records the final status of a job
+func FinishJob(jobID int64, status, errorMsg string) error {
+	query := `
+		UPDATE jobs SET status = $2, error = $3, finished_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+
+	if _, err := db.Exec(query, jobID, status, errorMsg); err != nil {
+		return fmt.Errorf("failed to finish job: %w", err)
+	}
+
+	return nil
+}
+
+// InterruptRunningJobs marks the running jobs of worker as interrupted and returns them
+// It is meant for startup, when no job of the worker can still be running;
+// jobs claimed by other workers are left alone
+func InterruptRunningJobs(worker, reason string) ([]*Job, error) {
+	rows, err := db.Query(`
+		UPDATE jobs SET status = $1, error = $2, finished_at = CURRENT_TIMESTAMP
+		WHERE status = $3 AND worker = $4
+		RETURNING `+jobColumns,
+		JobInterrupted, reason, JobRunning, worker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to interrupt running jobs: %w", err)
+	}
+	return scanJobs(rows)
+}
+
+// RequeueJob adds a new queued job with the trigger, group, policy and payload of job
+// The new job keeps counting the attempts of job, so its run knows it is a rerun
+func RequeueJob(job *Job) (int64, error) {
+	id, _, err := enqueueJob(job.TriggerID, job.ConcurrencyGroup, job.Policy, job.Payload, job.Attempts, false, "")
+	return id, err
+}
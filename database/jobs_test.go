@@ -0,0 +1,258 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// enqueueTestJob queues a job for a new trigger and returns its id
+func enqueueTestJob(t *testing.T, group string, supersede bool) (int64, []*Job) {
+	t.Helper()
+	id, superseded, err := EnqueueJob(newTestTrigger(t), group, "test", []byte(`{}`), supersede, "superseded by a newer run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, superseded
+}
+
+// jobStatus returns the status of a job
+func jobStatus(t *testing.T, id int64) string {
+	t.Helper()
+	var status string
+	if err := db.QueryRow(`SELECT status FROM jobs WHERE id = $1`, id).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestEnqueueJobSupersedesQueuedJobs(t *testing.T) {
+	openTestDB(t)
+
+	first, _ := enqueueTestJob(t, "app", false)
+	second, _ := enqueueTestJob(t, "app", false)
+	other, _ := enqueueTestJob(t, "other", false)
+
+	newest, superseded := enqueueTestJob(t, "app", true)
+	if len(superseded) != 2 || superseded[0].ID != first || superseded[1].ID != second {
+		t.Fatalf("superseded %v, want jobs %d and %d", superseded, first, second)
+	}
+	for _, id := range []int64{first, second} {
+		if status := jobStatus(t, id); status != JobSkipped {
+			t.Errorf("superseded job %d is %s, want %s", id, status, JobSkipped)
+		}
+	}
+	if status := jobStatus(t, newest); status != JobQueued {
+		t.Errorf("new job is %s, want %s", status, JobQueued)
+	}
+	if status := jobStatus(t, other); status != JobQueued {
+		t.Errorf("job of another group is %s, want %s", status, JobQueued)
+	}
+}
+
+func TestRequestCancelReachesTheClaimingWorker(t *testing.T) {
+	openTestDB(t)
+
+	enqueueTestJob(t, "app", false)
+	running, err := ClaimJob("worker-a")
+	if err != nil || running == nil {
+		t.Fatalf("ClaimJob = %v, %v", running, err)
+	}
+
+	// Nothing is requested before a newer run cancels the group
+	if jobs, err := CancelRequestedJobs("worker-a"); err != nil || len(jobs) != 0 {
+		t.Fatalf("CancelRequestedJobs before the request = %d jobs, %v", len(jobs), err)
+	}
+
+	requested, err := RequestCancel("app", "superseded by run 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 || requested[0].ID != running.ID || requested[0].Worker != "worker-a" {
+		t.Fatalf("RequestCancel returned %v, want job %d of worker-a", requested, running.ID)
+	}
+
+	// Only the worker running the job sees the request when it polls
+	if jobs, err := CancelRequestedJobs("worker-b"); err != nil || len(jobs) != 0 {
+		t.Errorf("CancelRequestedJobs of another worker = %d jobs, %v", len(jobs), err)
+	}
+	jobs, err := CancelRequestedJobs("worker-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != running.ID || jobs[0].CancelReason != "superseded by run 2" {
+		t.Fatalf("CancelRequestedJobs = %v, want job %d with its reason", jobs, running.ID)
+	}
+
+	// Finished jobs are not cancelled again
+	if err := FinishJob(running.ID, JobCancelled, "cancelled: superseded by run 2"); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err := CancelRequestedJobs("worker-a"); err != nil || len(jobs) != 0 {
+		t.Errorf("CancelRequestedJobs after the job finished = %d jobs, %v", len(jobs), err)
+	}
+}
+
+func TestClaimJob(t *testing.T) {
+	openTestDB(t)
+
+	if job, err := ClaimJob("worker-a"); err != nil || job != nil {
+		t.Fatalf("ClaimJob on an empty queue = %v, %v, want nothing", job, err)
+	}
+
+	appFirst, _ := enqueueTestJob(t, "app", false)
+	appSecond, _ := enqueueTestJob(t, "app", false)
+	other, _ := enqueueTestJob(t, "other", false)
+
+	// Oldest job first, then the next group since app has a running job
+	for _, want := range []int64{appFirst, other} {
+		job, err := ClaimJob("worker-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil || job.ID != want {
+			t.Fatalf("claimed %v, want job %d", job, want)
+		}
+		if job.Status != JobRunning || job.Worker != "worker-a" || job.Attempts != 1 || job.ClaimedAt == nil {
+			t.Errorf("claimed job %d: status %s, worker %q, attempts %d", job.ID, job.Status, job.Worker, job.Attempts)
+		}
+	}
+	if job, err := ClaimJob("worker-b"); err != nil || job != nil {
+		t.Fatalf("ClaimJob with every group running = %v, %v, want nothing", job, err)
+	}
+
+	if err := FinishJob(appFirst, JobDone, ""); err != nil {
+		t.Fatal(err)
+	}
+	job, err := ClaimJob("worker-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.ID != appSecond {
+		t.Fatalf("claimed %v after the running job finished, want job %d", job, appSecond)
+	}
+}
+
+func TestClaimJobConcurrently(t *testing.T) {
+	openTestDB(t)
+
+	const groups, jobsPerGroup, workers = 4, 5, 8
+	for i := 0; i < jobsPerGroup; i++ {
+		for g := 0; g < groups; g++ {
+			enqueueTestJob(t, fmt.Sprintf("group-%d", g), false)
+		}
+	}
+
+	// Workers claim and finish jobs concurrently until the queue is empty
+	var mu sync.Mutex
+	claimed := make(map[int64]int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			for idle := 0; idle < 20; {
+				job, err := ClaimJob(worker)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if job == nil {
+					idle++
+					time.Sleep(5 * time.Millisecond)
+					continue
+				}
+				idle = 0
+
+				// No other job of the group may be running alongside this one
+				var running int
+				if err := db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE concurrency_group = $1 AND status = $2`, job.ConcurrencyGroup, JobRunning).Scan(&running); err != nil {
+					errs <- err
+					return
+				}
+				if running != 1 {
+					errs <- fmt.Errorf("group %s has %d running jobs", job.ConcurrencyGroup, running)
+				}
+
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				if err := FinishJob(job.ID, JobDone, ""); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(fmt.Sprintf("worker-%d", w))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(claimed) != groups*jobsPerGroup {
+		t.Errorf("claimed %d jobs, want %d", len(claimed), groups*jobsPerGroup)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %d was claimed %d times", id, n)
+		}
+	}
+}
+
+func TestInterruptRunningJobs(t *testing.T) {
+	openTestDB(t)
+
+	enqueueTestJob(t, "app", false)
+	enqueueTestJob(t, "other", false)
+	queued, _ := enqueueTestJob(t, "app", false)
+	mine, err := ClaimJob("worker-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := ClaimJob("worker-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interrupted, err := InterruptRunningJobs("worker-a", "interrupted by restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interrupted) != 1 || interrupted[0].ID != mine.ID {
+		t.Fatalf("interrupted %v, want only job %d of worker-a", interrupted, mine.ID)
+	}
+	if interrupted[0].Status != JobInterrupted || interrupted[0].Error != "interrupted by restart" {
+		t.Errorf("interrupted job: status %s, error %q", interrupted[0].Status, interrupted[0].Error)
+	}
+	if status := jobStatus(t, theirs.ID); status != JobRunning {
+		t.Errorf("job of another worker is %s, want %s", status, JobRunning)
+	}
+	if status := jobStatus(t, queued); status != JobQueued {
+		t.Errorf("queued job is %s, want %s", status, JobQueued)
+	}
+
+	// A requeued job runs after the jobs queued before it and keeps counting attempts
+	requeued, err := RequeueJob(interrupted[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int64{queued, requeued} {
+		job, err := ClaimJob("worker-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil || job.ID != want {
+			t.Fatalf("claimed %v, want job %d", job, want)
+		}
+		if job.ID == requeued && (job.TriggerID != mine.TriggerID || job.Attempts != 2) {
+			t.Errorf("requeued job: trigger %d, attempts %d, want trigger %d and 2 attempts", job.TriggerID, job.Attempts, mine.TriggerID)
+		}
+		if err := FinishJob(job.ID, JobDone, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Notification statuses
+const (
+	NotificationPending = "pending"
+	NotificationSent    = "sent"
+	NotificationDead    = "dead" // gave up after the last attempt
+)
+
+// Notification is a message waiting in the outbox for one destination
+// The destination is stored by name and resolved from config when sending,
+// so rotated webhook secrets apply to retries and no secret is stored
+type Notification struct {
+	ID            int64
+	TriggerID     int64
+	Project       string
+	Environment   string
+	Target        string
+	Status        string
+	Message       []byte
+	Attempts      int
+	LastError     string
+	ExternalID    string // id of the message at the destination, for destinations that update messages in place
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	SentAt        *time.Time
+}
+
+// createNotificationsTable creates the outbox of notifications
+func createNotificationsTable() error {
+	notificationsTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id BIGSERIAL PRIMARY KEY,
+		trigger_id INTEGER NOT NULL DEFAULT 0,
+		project VARCHAR(255) NOT NULL DEFAULT '',
+		environment VARCHAR(255) NOT NULL DEFAULT '',
+		target VARCHAR(255) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		message JSONB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS notifications_status_idx ON notifications (status, next_attempt_at, id);
+	CREATE INDEX IF NOT EXISTS notifications_trigger_id_idx ON notifications (trigger_id, id);`
+
+	if _, err := db.Exec(notificationsTable); err != nil {
+		return fmt.Errorf("failed to create notifications table: %w", err)
+	}
+
+	return nil
+}
+
+const notificationColumns = `id, trigger_id, project, environment, target, status, message, attempts, last_error, external_id, next_attempt_at, created_at, sent_at`
+
+// scanNotification reads a row selected with notificationColumns
+func scanNotification(row interface{ Scan(...interface{}) error }) (*Notification, error) {
+	var n Notification
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&n.ID,
+		&n.TriggerID,
+		&n.Project,
+		&n.Environment,
+		&n.Target,
+		&n.Status,
+		&n.Message,
+		&n.Attempts,
+		&n.LastError,
+		&n.ExternalID,
+		&n.NextAttemptAt,
+		&n.CreatedAt,
+		&sentAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if sentAt.Valid {
+		n.SentAt = &sentAt.Time
+	}
+	return &n, nil
+}
+
+// scanNotifications reads all rows selected with notificationColumns and closes them
+func scanNotifications(rows *sql.Rows) ([]*Notification, error) {
+	defer rows.Close()
+
+	notifications := make([]*Notification, 0)
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read notifications: %w", err)
+	}
+	return notifications, nil
+}
+
+// EnqueueNotification stores a pending notification for one destination and returns its id
+func EnqueueNotification(n Notification) (int64, error) {
+	query := `
+		INSERT INTO notifications (trigger_id, project, environment, target, status, message)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	var id int64
+	if err := db.QueryRow(query, n.TriggerID, n.Project, n.Environment, n.Target, NotificationPending, n.Message).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to enqueue notification: %w", err)
+	}
+
+	return id, nil
+}
+
+// ClaimNotification returns the oldest pending notification that is due, or nil if there is none
+// Notifications of a run wait for older pending ones to the same destination, so
+// cards arrive in order. A claimed notification is not due again until lease has
+// passed, so a sender that dies while sending leaves it to be retried
+func ClaimNotification(lease time.Duration) (*Notification, error) {
+	query := `
+		UPDATE notifications SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+		WHERE id = (
+			SELECT n.id FROM notifications n
+			WHERE n.status = $1 AND n.next_attempt_at <= CURRENT_TIMESTAMP
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications o
+				WHERE o.status = $1 AND o.trigger_id = n.trigger_id AND o.target = n.target
+				AND o.id < n.id AND n.trigger_id <> 0
+			)
+			ORDER BY n.id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + notificationColumns
+
+	n, err := scanNotification(db.QueryRow(query, NotificationPending, lease.Milliseconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim notification: %w", err)
+	}
+
+	return n, nil
+}
+
+// MarkNotificationSent records a successful delivery, with the id of the message
+// at the destination if it has one
+func MarkNotificationSent(id int64, externalID string) error {
+	query := `
+		UPDATE notifications SET status = $2, attempts = attempts + 1, last_error = '', external_id = $3, sent_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+
+	if _, err := db.Exec(query, id, NotificationSent, externalID); err != nil {
+		return fmt.Errorf("failed to mark notification %d as sent: %w", id, err)
+	}
+	return nil
+}
+
+// MarkNotificationFailed records a failed attempt, the notification is retried
+// after retryIn or, if dead is set, given up
+func MarkNotificationFailed(id int64, errorMsg string, retryIn time.Duration, dead bool) error {
+	status := NotificationPending
+	if dead {
+		status = NotificationDead
+	}
+	query := `
+		UPDATE notifications SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = CURRENT_TIMESTAMP + $4 * INTERVAL '1 millisecond'
+		WHERE id = $1`
+
+	if _, err := db.Exec(query, id, status, errorMsg, retryIn.Milliseconds()); err != nil {
+		return fmt.Errorf("failed to record failed notification %d: %w", id, err)
+	}
+	return nil
+}
+
+// ListNotifications returns the newest notifications, optionally only those with a status
+func ListNotifications(status string, limit int) ([]*Notification, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notifications
+		WHERE ($1 = '' OR status = $1)
+		ORDER BY id DESC
+		LIMIT $2`
+
+	rows, err := db.Query(query, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notifications: %w", err)
+	}
+	return scanNotifications(rows)
+}
+
+// GetNotification returns a notification by id, or sql.ErrNoRows if it does not exist
+func GetNotification(id int64) (*Notification, error) {
+	n, err := scanNotification(db.QueryRow(`SELECT `+notificationColumns+` FROM notifications WHERE id = $1`, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notification %d: %w", id, err)
+	}
+	return n, nil
+}
+
+// ResendNotification makes a notification pending again with fresh attempts,
+// due immediately; sent notifications are resent too
+func ResendNotification(id int64) (*Notification, error) {
+	query := `
+		UPDATE notifications SET status = $2, attempts = 0, last_error = '', next_attempt_at = CURRENT_TIMESTAMP, sent_at = NULL
+		WHERE id = $1
+		RETURNING ` + notificationColumns
+
+	n, err := scanNotification(db.QueryRow(query, id, NotificationPending))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resend notification %d: %w", id, err)
+	}
+	return n, nil
+}
+
+// NotificationExternalID returns the id of the message sent to a destination
+// for a run, or an empty string if none was sent yet
+func NotificationExternalID(triggerID int64, target string) (string, error) {
+	query := `
+		SELECT external_id FROM notifications
+		WHERE trigger_id = $1 AND target = $2 AND external_id <> ''
+		ORDER BY id DESC
+		LIMIT 1`
+
+	var externalID string
+	err := db.QueryRow(query, triggerID, target).Scan(&externalID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get message id of run %d for %s: %w", triggerID, target, err)
+	}
+	return externalID, nil
+}
@@ -1,7 +1,11 @@
 package executor
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,61 +16,148 @@ import (
 	"time"
 )
 
+// Execution statuses recorded for each command
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	StatusTimeout = "timeout"
+	StatusSkipped = "skipped"
+)
+
+// Aggregate run statuses computed from every step result by RunStatus
+const (
+	RunSuccess = "success" // every step succeeded
+	RunPartial = "partial" // every required step succeeded, an optional one did not
+	RunFailed  = "failed"  // a required step failed, timed out or was skipped
+)
+
+// killGrace is how long a cancelled command's process group has to exit after
+// SIGTERM before it is killed with SIGKILL; tests shorten it
+var killGrace = 10 * time.Second
+
+// waitDelay bounds how long we wait for a cancelled command to exit and its
+// output pipes to close, in case a detached grandchild is still holding them open
+var waitDelay = killGrace + 5*time.Second
+
+// retryDelay is the pause between attempts of a step that is retried
+const retryDelay = 2 * time.Second
+
+// Step describes a single command to execute
+type Step struct {
+	Name         string        // Display name, defaults to the command
+	Command      string        // Shell command or script path
+	Dir          string        // Working directory, empty for the current one
+	Env          []string      // Extra environment variables as KEY=VALUE
+	Timeout      time.Duration // 0 means no timeout
+	Retries      int           // Extra attempts after a failure
+	AllowFailure bool          // Optional step, its failure does not stop or fail the run
+	Needs        []string      // Names of steps that must finish first (ExecuteGraph only)
+}
+
+// PullRequest describes the pull request a run checks
+type PullRequest struct {
+	Number  int
+	Title   string
+	Action  string
+	Author  string
+	BaseRef string
+	HeadRef string
+	Merged  bool
+}
+
+// Options carries the context shared by every step of a run
+type Options struct {
+	Branch       string // empty for tag pushes and releases
+	Repo         string
+	CommitID     string
+	RefType      string // branch, tag, release or pull_request
+	Tag          string
+	ReleaseName  string
+	ReleaseNotes string
+	PullRequest  *PullRequest // set for pull request checks
+	Environment  string       // deployment environment, empty for projects without environments
+	Env          []string     // extra environment variables for every step as KEY=VALUE
+	ChangedFiles string       // file listing the files changed by a push, one per line, empty if unknown
+	OnLine       LineHandler  // optional, receives output while steps run
+	OnStep       StepHandler  // optional, told when steps start and finish
+}
+
+// StepHandler is told when a step starts, with a nil result, and when it
+// finishes or is skipped, with its result
+// Steps run concurrently, so a handler must be safe for concurrent use
+type StepHandler func(step string, result *ExecutionResult)
+
 // ExecutionResult represents the result of executing a script or command
 type ExecutionResult struct {
-	ScriptName string
-	Success    bool
-	Output     string
-	Error      string
-	StartTime  time.Time
-	EndTime    time.Time
-	Duration   time.Duration
+	ScriptName   string
+	StepName     string
+	Dir          string
+	Success      bool
+	Status       string
+	Output       string // stdout and stderr interleaved as they were written
+	Stdout       string
+	Stderr       string
+	ExitCode     int    // -1 when the command did not exit normally
+	Signal       string // signal that terminated the command, if any
+	Error        string
+	Attempts     int
+	AllowFailure bool
+	StartTime    time.Time
+	EndTime      time.Time
+	Duration     time.Duration
 }
 
-// ExecuteCommands executes commands from config with branch and repo context
+// ExecuteCommands executes commands from config with the run context in opts
 // Sequential commands run one after another, stopping on first failure
-// Async commands run in parallel
-func ExecuteCommands(sequentialCommands, asyncCommands []string, branch, repoName string) ([]ExecutionResult, error) {
+// Async commands run in parallel, and any required one failing fails the run
+// Failures of steps marked AllowFailure are recorded but never stop the run.
+// A command that exceeds its timeout, or is still running when ctx is cancelled,
+// is terminated together with its whole process group
+func ExecuteCommands(ctx context.Context, sequentialCommands, asyncCommands []Step, opts Options) ([]ExecutionResult, error) {
 	results := make([]ExecutionResult, 0)
 	
 	// Set up environment variables for scripts
-	env := os.Environ()
-	env = append(env, fmt.Sprintf("GITHUB_BRANCH=%s", branch))
-	env = append(env, fmt.Sprintf("GITHUB_REPO=%s", repoName))
-	env = append(env, fmt.Sprintf("GITHUB_REPOSITORY=%s", repoName))
+	env := buildEnv(opts)
 	
 	// Execute sequential commands first (stop on failure)
-	for _, cmd := range sequentialCommands {
-		if cmd == "" {
+	for _, step := range sequentialCommands {
+		if step.Command == "" {
 			continue
 		}
-		result := executeCommand(cmd, env)
+		if err := ctx.Err(); err != nil {
+			return results, fmt.Errorf("execution cancelled before %s: %w", step.displayName(), err)
+		}
+		result := runStep(ctx, step, env, opts)
 		results = append(results, result)
 		
-		if !result.Success {
+		if !result.Success && result.Required() {
 			// Stop on first failure
-			return results, fmt.Errorf("command failed: %s - %s", result.ScriptName, result.Error)
+			return results, fmt.Errorf("command failed: %s - %s", result.StepName, result.Error)
 		}
 	}
 	
 	// Execute async commands in parallel
 	if len(asyncCommands) > 0 {
+		if err := ctx.Err(); err != nil {
+			return results, fmt.Errorf("execution cancelled before async commands: %w", err)
+		}
+
 		var wg sync.WaitGroup
 		asyncResults := make([]ExecutionResult, 0)
 		mu := sync.Mutex{}
 		
-		for _, cmd := range asyncCommands {
-			if cmd == "" {
+		for _, step := range asyncCommands {
+			if step.Command == "" {
 				continue
 			}
 			wg.Add(1)
-			go func(command string) {
+			go func(step Step) {
 				defer wg.Done()
-				result := executeCommand(command, env)
+				result := runStep(ctx, step, env, opts)
 				mu.Lock()
 				asyncResults = append(asyncResults, result)
 				mu.Unlock()
-			}(cmd)
+			}(step)
 		}
 		
 		// Wait for all async commands to complete
@@ -76,6 +167,12 @@ func ExecuteCommands(sequentialCommands, asyncCommands []string, branch, repoNam
 		wg.Wait()
 		
 		results = append(results, asyncResults...)
+
+		for _, result := range asyncResults {
+			if !result.Success && result.Required() {
+				return results, fmt.Errorf("async command failed: %s - %s", result.StepName, result.Error)
+			}
+		}
 	}
 	
 	// All commands have completed at this point
@@ -85,6 +182,122 @@ func ExecuteCommands(sequentialCommands, asyncCommands []string, branch, repoNam
 	return results, nil
 }
 
+// Required reports whether the step has to succeed for the run to succeed
+func (r ExecutionResult) Required() bool {
+	return !r.AllowFailure
+}
+
+// RunStatus aggregates step results into RunSuccess, RunPartial or RunFailed
+func RunStatus(results []ExecutionResult) string {
+	status := RunSuccess
+	for _, result := range results {
+		if result.Success {
+			continue
+		}
+		if result.Required() {
+			return RunFailed
+		}
+		status = RunPartial
+	}
+	return status
+}
+
+// buildEnv returns the environment shared by every command of a run
+func buildEnv(opts Options) []string {
+	env := os.Environ()
+	env = append(env, fmt.Sprintf("GITHUB_BRANCH=%s", opts.Branch))
+	env = append(env, fmt.Sprintf("GITHUB_REPO=%s", opts.Repo))
+	env = append(env, fmt.Sprintf("GITHUB_REPOSITORY=%s", opts.Repo))
+	if opts.CommitID != "" {
+		env = append(env, fmt.Sprintf("GITHUB_SHA=%s", opts.CommitID))
+	}
+	if opts.RefType != "" {
+		env = append(env, fmt.Sprintf("GITHUB_REF_TYPE=%s", opts.RefType))
+	}
+	if pr := opts.PullRequest; pr != nil {
+		env = append(env, fmt.Sprintf("GITHUB_PR_NUMBER=%d", pr.Number))
+		env = append(env, fmt.Sprintf("GITHUB_PR_TITLE=%s", pr.Title))
+		env = append(env, fmt.Sprintf("GITHUB_PR_ACTION=%s", pr.Action))
+		env = append(env, fmt.Sprintf("GITHUB_PR_AUTHOR=%s", pr.Author))
+		env = append(env, fmt.Sprintf("GITHUB_PR_MERGED=%t", pr.Merged))
+		env = append(env, fmt.Sprintf("GITHUB_BASE_REF=%s", pr.BaseRef))
+		env = append(env, fmt.Sprintf("GITHUB_HEAD_REF=%s", pr.HeadRef))
+	}
+	if opts.Tag != "" {
+		env = append(env, fmt.Sprintf("GITHUB_TAG=%s", opts.Tag))
+	}
+	if opts.RefType == "release" {
+		env = append(env, fmt.Sprintf("GITHUB_RELEASE_NAME=%s", opts.ReleaseName))
+		env = append(env, fmt.Sprintf("GITHUB_RELEASE_NOTES=%s", opts.ReleaseNotes))
+	}
+	if opts.Environment != "" {
+		env = append(env, fmt.Sprintf("DEPLOY_ENVIRONMENT=%s", opts.Environment))
+	}
+	if opts.ChangedFiles != "" {
+		env = append(env, fmt.Sprintf("GITHUB_CHANGED_FILES_PATH=%s", opts.ChangedFiles))
+	}
+	env = append(env, opts.Env...)
+	return env
+}
+
+// displayName returns the step name, falling back to its command
+func (s Step) displayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Command
+}
+
+// runStep executes a step and tells opts.OnStep about it
+func runStep(ctx context.Context, step Step, env []string, opts Options) ExecutionResult {
+	if opts.OnStep != nil {
+		opts.OnStep(step.displayName(), nil)
+	}
+	result := executeStep(ctx, step, env, opts.OnLine)
+	if opts.OnStep != nil {
+		opts.OnStep(result.StepName, &result)
+	}
+	return result
+}
+
+// executeStep runs a step, retrying it up to step.Retries times after a failure
+// The returned result is the one of the last attempt, timed from the first attempt
+// Output lines of every attempt are passed to onLine, which may be nil
+func executeStep(ctx context.Context, step Step, baseEnv []string, onLine LineHandler) ExecutionResult {
+	env := baseEnv
+	if len(step.Env) > 0 {
+		env = append(append([]string{}, baseEnv...), step.Env...)
+	}
+
+	var result ExecutionResult
+	startTime := time.Now()
+	for attempt := 1; ; attempt++ {
+		if onLine != nil {
+			stdout := newLineWriter(step.displayName(), attempt, StreamStdout, onLine)
+			stderr := newLineWriter(step.displayName(), attempt, StreamStderr, onLine)
+			result = executeCommand(ctx, step.Command, step.Dir, env, step.Timeout, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+		} else {
+			result = executeCommand(ctx, step.Command, step.Dir, env, step.Timeout, nil, nil)
+		}
+		result.Attempts = attempt
+		if result.Success || attempt > step.Retries || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+	}
+
+	result.StepName = step.displayName()
+	result.AllowFailure = step.AllowFailure
+	result.StartTime = startTime
+	result.Duration = result.EndTime.Sub(startTime)
+	return result
+}
+
 // ExecuteScripts executes scripts from the specified folder sequentially
 // Scripts are expected to be named like 001.sh, 002.sh, etc.
 // Stops on first failure
@@ -154,8 +367,16 @@ func GetScripts(scriptsFolder string) ([]string, error) {
 	return scripts, nil
 }
 
-// executeCommand executes a single command with environment variables
-func executeCommand(command string, env []string) ExecutionResult {
+// executeCommand executes a single command with environment variables in dir
+// The command is terminated (with its process group) when timeout elapses or ctx is cancelled
+// Output is also copied to stdoutSink and stderrSink as it is written when they are not nil
+func executeCommand(ctx context.Context, command, dir string, env []string, timeout time.Duration, stdoutSink, stderrSink io.Writer) ExecutionResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// Record start time before executing the command
 	startTime := time.Now()
 	
@@ -163,22 +384,49 @@ func executeCommand(command string, env []string) ExecutionResult {
 	var cmd *exec.Cmd
 	if strings.HasSuffix(command, ".sh") || strings.HasPrefix(command, "./") || strings.HasPrefix(command, "/") {
 		// It's a script file
-		cmd = exec.Command("bash", command)
+		cmd = exec.CommandContext(ctx, "bash", command)
 	} else {
 		// It's a shell command
-		cmd = exec.Command("bash", "-c", command)
+		cmd = exec.CommandContext(ctx, "bash", "-c", command)
 	}
 	
 	cmd.Env = env
-	output, err := cmd.CombinedOutput()
+	cmd.Dir = dir
+	exited := make(chan struct{})
+	defer close(exited)
+	setProcessGroup(cmd, exited)
+	cmd.WaitDelay = waitDelay
+
+	// Buffer each stream on its own and both together in write order
+	var stdout, stderr bytes.Buffer
+	output := &syncBuffer{}
+	stdoutWriters := []io.Writer{&stdout, output}
+	stderrWriters := []io.Writer{&stderr, output}
+	if stdoutSink != nil {
+		stdoutWriters = append(stdoutWriters, stdoutSink)
+	}
+	if stderrSink != nil {
+		stderrWriters = append(stderrWriters, stderrSink)
+	}
+	cmd.Stdout = io.MultiWriter(stdoutWriters...)
+	cmd.Stderr = io.MultiWriter(stderrWriters...)
+	err := cmd.Run()
 	
 	// Record end time immediately after command completes
 	endTime := time.Now()
 	duration := endTime.Sub(startTime)
 
+	exitCode, signal := processExit(cmd.ProcessState)
 	result := ExecutionResult{
 		ScriptName: command,
-		Output:     string(output),
+		StepName:   command,
+		Dir:        dir,
+		Output:     output.String(),
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		ExitCode:   exitCode,
+		Signal:     signal,
+		Attempts:   1,
 		StartTime:  startTime,
 		EndTime:    endTime,
 		Duration:   duration,
@@ -186,12 +434,20 @@ func executeCommand(command string, env []string) ExecutionResult {
 
 	if err != nil {
 		result.Success = false
+		result.Status = StatusFailed
 		result.Error = err.Error()
+		if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result.Status = StatusTimeout
+			result.Error = fmt.Sprintf("command timed out after %s", timeout)
+		} else if ctx.Err() != nil {
+			result.Error = fmt.Sprintf("command cancelled: %v", ctx.Err())
+		}
 		if result.Output == "" {
-			result.Output = err.Error()
+			result.Output = result.Error
 		}
 	} else {
 		result.Success = true
+		result.Status = StatusSuccess
 	}
 
 	return result
@@ -212,9 +468,14 @@ func executeScript(scriptPath string) ExecutionResult {
 	endTime := time.Now()
 	duration := endTime.Sub(startTime)
 
+	exitCode, signal := processExit(cmd.ProcessState)
 	result := ExecutionResult{
 		ScriptName: scriptName,
+		StepName:   scriptName,
 		Output:     string(output),
+		ExitCode:   exitCode,
+		Signal:     signal,
+		Attempts:   1,
 		StartTime:  startTime,
 		EndTime:    endTime,
 		Duration:   duration,
@@ -222,14 +483,42 @@ func executeScript(scriptPath string) ExecutionResult {
 
 	if err != nil {
 		result.Success = false
+		result.Status = StatusFailed
 		result.Error = err.Error()
 		if result.Output == "" {
 			result.Output = err.Error()
 		}
 	} else {
 		result.Success = true
+		result.Status = StatusSuccess
 	}
 
 	return result
 }
 
+// processExit returns the exit code and terminating signal of a finished process
+// A process that never started has exit code -1 and no signal
+func processExit(state *os.ProcessState) (int, string) {
+	if state == nil {
+		return -1, ""
+	}
+	return state.ExitCode(), exitSignal(state)
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of stdout and stderr
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,176 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ExecuteGraph executes steps as a dependency graph with the run context in opts
+// A step starts as soon as every step named in its Needs has finished, so
+// independent branches of the graph run concurrently. Dependents of a failed
+// step are not run and are reported with StatusSkipped, unless the failed step
+// is marked AllowFailure. Results are returned in the order steps were given.
+// When ctx is cancelled, steps not yet started are skipped and the returned
+// error wraps ctx's error.
+func ExecuteGraph(ctx context.Context, steps []Step, opts Options) ([]ExecutionResult, error) {
+	env := buildEnv(opts)
+
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if _, ok := index[step.displayName()]; ok {
+			return nil, fmt.Errorf("more than one step is named %s", step.displayName())
+		}
+		index[step.displayName()] = i
+	}
+
+	// remaining counts unfinished needs, dependents is the reverse edge list
+	remaining := make([]int, len(steps))
+	dependents := make([][]int, len(steps))
+	blockedBy := make([]string, len(steps))
+	for i, step := range steps {
+		for _, need := range step.Needs {
+			j, ok := index[need]
+			if !ok {
+				return nil, fmt.Errorf("step %s needs unknown step %s", step.displayName(), need)
+			}
+			remaining[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	results := make([]ExecutionResult, len(steps))
+	finished := make([]bool, len(steps))
+	completed := make(chan int)
+	running := 0
+	var firstFailure error
+
+	// ready holds steps whose needs have all finished and which still have to be
+	// started or skipped; skipping a step may in turn make its dependents ready
+	ready := make([]int, 0, len(steps))
+	for i := range steps {
+		if remaining[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	skip := func(i int, reason string) {
+		results[i] = skippedResult(steps[i], reason)
+		if opts.OnStep != nil {
+			opts.OnStep(results[i].StepName, &results[i])
+		}
+	}
+
+	finish := func(i int) {
+		finished[i] = true
+		result := results[i]
+		failed := !result.Success && result.Status != StatusSkipped && result.Required()
+		if failed && firstFailure == nil {
+			firstFailure = fmt.Errorf("command failed: %s - %s", result.StepName, result.Error)
+		}
+		for _, dependent := range dependents[i] {
+			if blockedBy[dependent] == "" {
+				if failed {
+					blockedBy[dependent] = "needs failed step " + result.StepName
+				} else if result.Status == StatusSkipped {
+					blockedBy[dependent] = "needs skipped step " + result.StepName
+				}
+			}
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	for {
+		for len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			if reason := blockedBy[i]; reason != "" {
+				skip(i, reason)
+				finish(i)
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				skip(i, fmt.Sprintf("execution cancelled: %v", err))
+				if firstFailure == nil {
+					firstFailure = fmt.Errorf("execution cancelled before %s: %w", steps[i].displayName(), err)
+				}
+				finish(i)
+				continue
+			}
+			running++
+			go func(i int) {
+				results[i] = runStep(ctx, steps[i], env, opts)
+				completed <- i
+			}(i)
+		}
+		if running == 0 {
+			break
+		}
+		i := <-completed
+		running--
+		finish(i)
+	}
+
+	// onCycle reports whether step i needs itself through steps that never finished
+	onCycle := func(i int) bool {
+		seen := make([]bool, len(steps))
+		stack := []int{i}
+		for len(stack) > 0 {
+			j := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, need := range steps[j].Needs {
+				k := index[need]
+				if k == i {
+					return true
+				}
+				if !finished[k] && !seen[k] {
+					seen[k] = true
+					stack = append(stack, k)
+				}
+			}
+		}
+		return false
+	}
+
+	// Anything left unfinished is part of a dependency cycle, or needs a step
+	// that is, directly or through other unfinished steps
+	for i := range steps {
+		if finished[i] {
+			continue
+		}
+		if onCycle(i) {
+			skip(i, "dependency cycle")
+			if firstFailure == nil {
+				firstFailure = fmt.Errorf("step %s is part of a dependency cycle", steps[i].displayName())
+			}
+			continue
+		}
+		for _, need := range steps[i].Needs {
+			if !finished[index[need]] {
+				skip(i, "blocked by "+need)
+				break
+			}
+		}
+	}
+
+	return results, firstFailure
+}
+
+// skippedResult records a step that was never run
+func skippedResult(step Step, reason string) ExecutionResult {
+	now := time.Now()
+	return ExecutionResult{
+		ScriptName:   step.Command,
+		StepName:     step.displayName(),
+		Dir:          step.Dir,
+		Status:       StatusSkipped,
+		ExitCode:     -1,
+		Error:        "skipped: " + reason,
+		AllowFailure: step.AllowFailure,
+		StartTime:    now,
+		EndTime:      now,
+	}
+}
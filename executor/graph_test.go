@@ -0,0 +1,194 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExecuteGraph(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []Step
+		wantStatus []string          // by step, in the order given
+		wantErr    string            // substring of the error, empty for none
+		wantReason map[string]string // error of skipped steps, by step name
+	}{
+		{
+			name: "independent steps",
+			steps: []Step{
+				{Name: "a", Command: "true"},
+				{Name: "b", Command: "true"},
+			},
+			wantStatus: []string{StatusSuccess, StatusSuccess},
+		},
+		{
+			name: "chain given out of order",
+			steps: []Step{
+				{Name: "deploy", Command: "true", Needs: []string{"build"}},
+				{Name: "build", Command: "true", Needs: []string{"test"}},
+				{Name: "test", Command: "true"},
+			},
+			wantStatus: []string{StatusSuccess, StatusSuccess, StatusSuccess},
+		},
+		{
+			name: "needs by command when unnamed",
+			steps: []Step{
+				{Command: "exit 0"},
+				{Name: "b", Command: "true", Needs: []string{"exit 0"}},
+			},
+			wantStatus: []string{StatusSuccess, StatusSuccess},
+		},
+		{
+			name: "failure skips dependents transitively",
+			steps: []Step{
+				{Name: "a", Command: "exit 1"},
+				{Name: "b", Command: "true", Needs: []string{"a"}},
+				{Name: "c", Command: "true", Needs: []string{"b"}},
+				{Name: "d", Command: "true"},
+			},
+			wantStatus: []string{StatusFailed, StatusSkipped, StatusSkipped, StatusSuccess},
+			wantErr:    "command failed: a",
+		},
+		{
+			name: "allowed failure does not block dependents",
+			steps: []Step{
+				{Name: "lint", Command: "exit 1", AllowFailure: true},
+				{Name: "build", Command: "true", Needs: []string{"lint"}},
+			},
+			wantStatus: []string{StatusFailed, StatusSuccess},
+		},
+		{
+			name: "diamond with one failed branch",
+			steps: []Step{
+				{Name: "root", Command: "true"},
+				{Name: "left", Command: "true", Needs: []string{"root"}},
+				{Name: "right", Command: "exit 2", Needs: []string{"root"}},
+				{Name: "join", Command: "true", Needs: []string{"left", "right"}},
+			},
+			wantStatus: []string{StatusSuccess, StatusSuccess, StatusFailed, StatusSkipped},
+			wantErr:    "command failed: right",
+		},
+		{
+			name: "cycle",
+			steps: []Step{
+				{Name: "a", Command: "true", Needs: []string{"b"}},
+				{Name: "b", Command: "true", Needs: []string{"a"}},
+				{Name: "c", Command: "true"},
+			},
+			wantStatus: []string{StatusSkipped, StatusSkipped, StatusSuccess},
+			wantErr:    "dependency cycle",
+		},
+		{
+			name: "self dependency",
+			steps: []Step{
+				{Name: "a", Command: "true", Needs: []string{"a"}},
+			},
+			wantStatus: []string{StatusSkipped},
+			wantErr:    "step a is part of a dependency cycle",
+		},
+		{
+			name: "dependent of a cycle",
+			steps: []Step{
+				{Name: "a", Command: "true", Needs: []string{"b"}},
+				{Name: "b", Command: "true", Needs: []string{"a"}},
+				{Name: "c", Command: "true", Needs: []string{"a"}},
+				{Name: "d", Command: "true", Needs: []string{"c"}},
+			},
+			wantStatus: []string{StatusSkipped, StatusSkipped, StatusSkipped, StatusSkipped},
+			wantErr:    "step a is part of a dependency cycle",
+			wantReason: map[string]string{
+				"a": "skipped: dependency cycle",
+				"b": "skipped: dependency cycle",
+				"c": "skipped: blocked by a",
+				"d": "skipped: blocked by c",
+			},
+		},
+	}
+	for _, tt := range tests {
+		results, err := ExecuteGraph(context.Background(), tt.steps, Options{})
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+		if len(results) != len(tt.steps) {
+			t.Errorf("%s: got %d results, want %d", tt.name, len(results), len(tt.steps))
+			continue
+		}
+		for i, result := range results {
+			if result.StepName != tt.steps[i].displayName() {
+				t.Errorf("%s: result %d is for step %q, want %q", tt.name, i, result.StepName, tt.steps[i].displayName())
+			}
+			if result.Status != tt.wantStatus[i] {
+				t.Errorf("%s: step %s status = %s, want %s (%s)", tt.name, result.StepName, result.Status, tt.wantStatus[i], result.Error)
+			}
+			if reason, ok := tt.wantReason[result.StepName]; ok && result.Error != reason {
+				t.Errorf("%s: step %s error = %q, want %q", tt.name, result.StepName, result.Error, reason)
+			}
+		}
+	}
+}
+
+func TestExecuteGraphStartsAfterNeeds(t *testing.T) {
+	steps := []Step{
+		{Name: "first", Command: "sleep 0.1"},
+		{Name: "second", Command: "true", Needs: []string{"first"}},
+	}
+	results, err := ExecuteGraph(context.Background(), steps, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1].StartTime.Before(results[0].EndTime) {
+		t.Errorf("second started at %s, before first ended at %s", results[1].StartTime, results[0].EndTime)
+	}
+}
+
+func TestExecuteGraphUnknownNeed(t *testing.T) {
+	steps := []Step{
+		{Name: "deploy", Command: "true", Needs: []string{"biuld"}},
+	}
+	results, err := ExecuteGraph(context.Background(), steps, Options{})
+	if err == nil || !strings.Contains(err.Error(), "needs unknown step biuld") {
+		t.Errorf("error = %v, want unknown step", err)
+	}
+	if results != nil {
+		t.Errorf("got %d results for an invalid graph, want none", len(results))
+	}
+}
+
+func TestExecuteGraphDuplicateName(t *testing.T) {
+	steps := []Step{
+		{Name: "build", Command: "make"},
+		{Command: "build"},
+		{Name: "deploy", Command: "true", Needs: []string{"build"}},
+	}
+	results, err := ExecuteGraph(context.Background(), steps, Options{})
+	if err == nil || !strings.Contains(err.Error(), "more than one step is named build") {
+		t.Errorf("error = %v, want duplicate step", err)
+	}
+	if results != nil {
+		t.Errorf("got %d results for an invalid graph, want none", len(results))
+	}
+}
+
+func TestExecuteGraphCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	steps := []Step{
+		{Name: "a", Command: "true"},
+		{Name: "b", Command: "true", Needs: []string{"a"}},
+	}
+	results, err := ExecuteGraph(ctx, steps, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	for _, result := range results {
+		if result.Status != StatusSkipped {
+			t.Errorf("step %s status = %s, want %s", result.StepName, result.Status, StatusSkipped)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Output streams written by a command
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Line is a single line of output written by a step while it runs
+type Line struct {
+	Step    string
+	Attempt int
+	Stream  string
+	Time    time.Time // when the line was read from the command
+	Text    string
+}
+
+// LineHandler receives output lines as steps write them
+// Steps run concurrently, so a handler must be safe for concurrent use
+type LineHandler func(Line)
+
+// lineWriter splits a command's output stream into lines for a LineHandler
+type lineWriter struct {
+	mu      sync.Mutex
+	step    string
+	attempt int
+	stream  string
+	handler LineHandler
+	partial []byte
+}
+
+func newLineWriter(step string, attempt int, stream string, handler LineHandler) *lineWriter {
+	return &lineWriter{step: step, attempt: attempt, stream: stream, handler: handler}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	data := p
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := data[:i]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = nil
+		}
+		w.emit(now, line)
+		data = data[i+1:]
+	}
+	w.partial = append(w.partial, data...)
+	return len(p), nil
+}
+
+// Flush emits output left after the last newline
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.emit(time.Now(), w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *lineWriter) emit(t time.Time, line []byte) {
+	w.handler(Line{
+		Step:    w.step,
+		Attempt: w.attempt,
+		Stream:  w.stream,
+		Time:    t,
+		Text:    string(bytes.TrimSuffix(line, []byte("\r"))),
+	})
+}
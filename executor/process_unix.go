@@ -0,0 +1,42 @@
+//go:build !windows
+
+package executor
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts the command in its own process group so that
+// cancelling it also stops any children the script has spawned
+// Cancellation sends SIGTERM to the group so scripts can clean up, and SIGKILL
+// if the group is still around killGrace later; exited must be closed once
+// the command has been waited for
+func setProcessGroup(cmd *exec.Cmd, exited <-chan struct{}) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// A negative pid signals every process in the group
+		pgid := -cmd.Process.Pid
+		if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+			return err
+		}
+		go func() {
+			select {
+			case <-exited:
+			case <-time.After(killGrace):
+				syscall.Kill(pgid, syscall.SIGKILL)
+			}
+		}()
+		return nil
+	}
+}
+
+// exitSignal returns the name of the signal that terminated the process, if any
+func exitSignal(state *os.ProcessState) string {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal().String()
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+//go:build !windows
+
+package executor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processGone reports whether pid has exited, counting zombies nobody reaped yet as gone
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestExecuteCommandsTerminatesProcessGroup(t *testing.T) {
+	grace, delay := killGrace, waitDelay
+	killGrace, waitDelay = 500*time.Millisecond, 2*time.Second
+	t.Cleanup(func() { killGrace, waitDelay = grace, delay })
+
+	tests := []struct {
+		name        string
+		command     string // starts a sleep in a subshell and writes its pid to $PIDFILE
+		timeout     time.Duration
+		cancelAfter time.Duration // cancels the run context instead of timing out when set
+		wantStatus  string
+		wantSignal  string
+		minElapsed  time.Duration
+		maxElapsed  time.Duration
+	}{
+		{
+			name:       "timeout terminates the group",
+			command:    `(sleep 30 & echo $! > "$PIDFILE"; wait)`,
+			timeout:    200 * time.Millisecond,
+			wantStatus: StatusTimeout,
+			wantSignal: "terminated",
+			minElapsed: 200 * time.Millisecond,
+			maxElapsed: 200*time.Millisecond + 2*time.Second,
+		},
+		{
+			name:       "group ignoring SIGTERM is killed after the grace period",
+			command:    `trap '' TERM; (sleep 30 & echo $! > "$PIDFILE"; wait)`,
+			timeout:    200 * time.Millisecond,
+			wantStatus: StatusTimeout,
+			wantSignal: "killed",
+			minElapsed: 200*time.Millisecond + 500*time.Millisecond,
+			maxElapsed: 200*time.Millisecond + 500*time.Millisecond + 2*time.Second,
+		},
+		{
+			name:        "cancelled run terminates the group",
+			command:     `(sleep 30 & echo $! > "$PIDFILE"; wait)`,
+			cancelAfter: 200 * time.Millisecond,
+			wantStatus:  StatusFailed,
+			wantSignal:  "terminated",
+			minElapsed:  200 * time.Millisecond,
+			maxElapsed:  200*time.Millisecond + 2*time.Second,
+		},
+	}
+	for _, tt := range tests {
+		pidFile := filepath.Join(t.TempDir(), "pid")
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancelAfter > 0 {
+			time.AfterFunc(tt.cancelAfter, cancel)
+		}
+
+		step := Step{Name: "sleep", Command: tt.command, Timeout: tt.timeout, Env: []string{"PIDFILE=" + pidFile}}
+		start := time.Now()
+		results, err := ExecuteCommands(ctx, []Step{step}, nil, Options{})
+		elapsed := time.Since(start)
+		cancel()
+
+		if err == nil {
+			t.Errorf("%s: got no error for a step that did not finish", tt.name)
+		}
+		if len(results) != 1 {
+			t.Errorf("%s: got %d results, want 1", tt.name, len(results))
+			continue
+		}
+		result := results[0]
+		if result.Status != tt.wantStatus {
+			t.Errorf("%s: status = %s, want %s (%s)", tt.name, result.Status, tt.wantStatus, result.Error)
+		}
+		if result.Signal != tt.wantSignal {
+			t.Errorf("%s: signal = %q, want %q", tt.name, result.Signal, tt.wantSignal)
+		}
+		if elapsed < tt.minElapsed || elapsed > tt.maxElapsed {
+			t.Errorf("%s: took %s, want between %s and %s", tt.name, elapsed, tt.minElapsed, tt.maxElapsed)
+		}
+
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			t.Errorf("%s: failed to read the pid of the sleep: %v", tt.name, err)
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			t.Errorf("%s: invalid pid %q", tt.name, data)
+			continue
+		}
+		// The sleep is reparented once the shell dies, give init a moment to reap it
+		deadline := time.Now().Add(time.Second)
+		for !processGone(pid) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !processGone(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Errorf("%s: sleep %d in the subshell is still running", tt.name, pid)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package executor
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows, where cancellation falls back to
+// killing only the direct child process
+func setProcessGroup(cmd *exec.Cmd, exited <-chan struct{}) {}
+
+// exitSignal always returns an empty string since Windows has no signals
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
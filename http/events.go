@@ -0,0 +1,203 @@
+package http
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/executor"
+	"github.com/google/go-github/v62/github"
+)
+
+// shaRegex matches a full commit SHA
+var shaRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// requestFromPush builds the run request of a branch or tag push
+// It returns a non-empty reason instead when the push cannot trigger a run
+func requestFromPush(event *github.PushEvent) (*runRequest, string) {
+	req := &runRequest{}
+	ref := event.GetRef()
+	switch {
+	case strings.HasPrefix(ref, "refs/tags/"):
+		req.RefType = config.RefTag
+		req.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	default:
+		req.RefType = config.RefBranch
+		req.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	}
+	setRepo(req, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName())
+
+	// Extract commit information from the head commit
+	headCommit := event.GetHeadCommit()
+	if headCommit == nil {
+		return nil, "no head commit"
+	}
+	req.CommitID = headCommit.GetID()
+	req.CommitMessage = headCommit.GetMessage()
+	req.CommitTime = headCommit.GetTimestamp().Time
+
+	// Get commit author (prefer committer, fallback to pusher)
+	req.Author = headCommit.GetAuthor().GetName()
+	if req.Author == "" {
+		req.Author = headCommit.GetAuthor().GetLogin()
+	}
+	if req.Author == "" {
+		req.Author = event.GetPusher().GetName()
+	}
+	if req.Author == "" {
+		req.Author = event.GetPusher().GetLogin()
+	}
+	if req.Author == "" {
+		req.Author = "unknown"
+	}
+
+	// The pusher's name is its login
+	req.Pusher = event.GetPusher().GetName()
+	req.Sender = event.GetSender().GetLogin()
+	req.ChangedFiles = changedFiles(event)
+	return req, ""
+}
+
+// maxPushCommits is the most commits GitHub lists in a push payload
+const maxPushCommits = 2048
+
+// changedFiles returns the files added, modified or removed by the commits of a push, sorted,
+// or nil when the payload does not list them all
+func changedFiles(event *github.PushEvent) []string {
+	commits := event.Commits
+	if len(commits) == 0 || len(commits) >= maxPushCommits || event.GetSize() > len(commits) {
+		return nil
+	}
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	for _, commit := range commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// requestFromRelease builds the run request of a published release
+// It returns a non-empty reason instead for other release actions
+func requestFromRelease(event *github.ReleaseEvent) (*runRequest, string) {
+	if event.GetAction() != "published" {
+		return nil, "release " + event.GetAction()
+	}
+	release := event.GetRelease()
+	req := &runRequest{
+		RefType:      config.RefRelease,
+		Tag:          release.GetTagName(),
+		ReleaseName:  release.GetName(),
+		ReleaseNotes: release.GetBody(),
+		CommitTime:   release.GetPublishedAt().Time,
+	}
+	if req.ReleaseName == "" {
+		req.ReleaseName = req.Tag
+	}
+	if req.CommitTime.IsZero() {
+		req.CommitTime = time.Now()
+	}
+	req.CommitMessage = req.ReleaseName
+	// target_commitish is a SHA only when the release was created from a commit, otherwise a branch name
+	if target := release.GetTargetCommitish(); shaRegex.MatchString(target) {
+		req.CommitID = target
+	}
+	setRepo(req, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName())
+
+	req.Sender = event.GetSender().GetLogin()
+	req.Author = release.GetAuthor().GetLogin()
+	if req.Author == "" {
+		req.Author = event.GetSender().GetLogin()
+	}
+	if req.Author == "" {
+		req.Author = "unknown"
+	}
+	return req, ""
+}
+
+// requestFromPullRequest builds the run request of a pull request event
+// The run checks the head commit of the pull request
+func requestFromPullRequest(event *github.PullRequestEvent) (*runRequest, string) {
+	pr := event.GetPullRequest()
+	req := &runRequest{
+		RefType:       config.RefPullRequest,
+		Branch:        pr.GetHead().GetRef(),
+		CommitID:      pr.GetHead().GetSHA(),
+		CommitMessage: pr.GetTitle(),
+		CommitTime:    pr.GetUpdatedAt().Time,
+		PRNumber:      pr.GetNumber(),
+		PRTitle:       pr.GetTitle(),
+		PRAction:      event.GetAction(),
+		PRAuthor:      pr.GetUser().GetLogin(),
+		PRMerged:      pr.GetMerged(),
+		BaseRef:       pr.GetBase().GetRef(),
+		HeadRef:       pr.GetHead().GetRef(),
+	}
+	if req.CommitID == "" {
+		return nil, "pull request has no head commit"
+	}
+	if req.CommitTime.IsZero() {
+		req.CommitTime = time.Now()
+	}
+	setRepo(req, event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName())
+
+	req.Sender = event.GetSender().GetLogin()
+	req.Author = req.PRAuthor
+	if req.Author == "" {
+		req.Author = event.GetSender().GetLogin()
+	}
+	if req.Author == "" {
+		req.Author = "unknown"
+	}
+	return req, ""
+}
+
+// setRepo fills in the repository of a run request
+func setRepo(req *runRequest, orgName, repoName string) {
+	req.OrgName = orgName
+	req.RepoName = repoName
+
+	// Build full repo name for display/logging purposes
+	req.FullRepoName = orgName + "/" + repoName
+	if req.FullRepoName == "/" {
+		req.FullRepoName = "unknown/repo"
+		req.OrgName = "unknown"
+		req.RepoName = "repo"
+	}
+}
+
+// refName returns the branch, tag or pull request base branch that selects the projects of a run
+func (req *runRequest) refName() string {
+	switch req.RefType {
+	case config.RefBranch:
+		return req.Branch
+	case config.RefPullRequest:
+		return req.BaseRef
+	}
+	return req.Tag
+}
+
+// pullRequest returns the pull request a run checks, nil for other runs
+func (req *runRequest) pullRequest() *executor.PullRequest {
+	if req.RefType != config.RefPullRequest {
+		return nil
+	}
+	return &executor.PullRequest{
+		Number:  req.PRNumber,
+		Title:   req.PRTitle,
+		Action:  req.PRAction,
+		Author:  req.PRAuthor,
+		BaseRef: req.BaseRef,
+		HeadRef: req.HeadRef,
+		Merged:  req.PRMerged,
+	}
+}
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/allintech/github-sentry/database"
+	"github.com/allintech/github-sentry/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// maxNotifications limits how many notifications a single request lists
+const maxNotifications = 100
+
+// Notifications lists the most recent notifications of the outbox, optionally
+// filtered by the "status" query parameter (pending, sent or dead)
+func Notifications(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		c.String(http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > maxNotifications {
+		limit = maxNotifications
+	}
+	status := c.Query("status")
+	switch status {
+	case "", database.NotificationPending, database.NotificationSent, database.NotificationDead:
+	default:
+		c.String(http.StatusBadRequest, "invalid status")
+		return
+	}
+
+	notifications, err := database.ListNotifications(status, limit)
+	if err != nil {
+		logger.LogError("failed to list notifications: %v", err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	items := make([]gin.H, 0, len(notifications))
+	for _, n := range notifications {
+		items = append(items, notificationJSON(n))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": items})
+}
+
+// ResendNotification queues a notification again with fresh attempts, usually
+// a dead one once its destination is reachable again
+func ResendNotification(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid notification id")
+		return
+	}
+	sender, ok := outboxFromContext(c)
+	if !ok {
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	n, err := database.ResendNotification(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.String(http.StatusNotFound, "notification not found")
+		return
+	}
+	if err != nil {
+		logger.LogError("failed to resend notification %d: %v", id, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	sender.Wake()
+
+	c.JSON(http.StatusOK, notificationJSON(n))
+}
+
+// notificationJSON is the API representation of an outbox notification
+func notificationJSON(n *database.Notification) gin.H {
+	return gin.H{
+		"id":              n.ID,
+		"run_id":          n.TriggerID,
+		"project":         n.Project,
+		"environment":     n.Environment,
+		"target":          n.Target,
+		"status":          n.Status,
+		"message":         json.RawMessage(n.Message),
+		"attempts":        n.Attempts,
+		"last_error":      n.LastError,
+		"next_attempt_at": n.NextAttemptAt,
+		"created_at":      n.CreatedAt,
+		"sent_at":         n.SentAt,
+	}
+}
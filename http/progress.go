@@ -0,0 +1,83 @@
+package http
+
+import (
+	"sync"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/executor"
+	"github.com/allintech/github-sentry/logger"
+	"github.com/allintech/github-sentry/notify"
+	"github.com/allintech/github-sentry/outbox"
+)
+
+// runProgress keeps the message of a running run up to date as its steps start
+// and finish, for destinations that update their messages in place
+type runProgress struct {
+	mu     sync.Mutex
+	sender *outbox.Sender
+	req    *runRequest
+	steps  []notify.StepResult
+}
+
+// newRunProgress returns the progress of a run about to execute its steps, or
+// nil if none of its destinations would show it
+func newRunProgress(sender *outbox.Sender, req *runRequest) *runProgress {
+	if !sender.UpdatesInPlace(req.ProjectName, req.Environment, notify.StatusStarted) {
+		return nil
+	}
+
+	var steps []config.StepConfig
+	if len(req.Project.Steps) > 0 {
+		steps = req.Project.Steps
+	} else {
+		steps = append(append(steps, req.Project.Sequential...), req.Project.Async...)
+	}
+	p := &runProgress{sender: sender, req: req}
+	for _, step := range steps {
+		if step.Command == "" {
+			continue
+		}
+		p.steps = append(p.steps, notify.StepResult{
+			Name:         step.DisplayName(),
+			Status:       "pending",
+			ExitCode:     -1,
+			AllowFailure: step.AllowFailure,
+		})
+	}
+	if len(p.steps) == 0 {
+		return nil
+	}
+	return p
+}
+
+// onStep is the executor's step handler, it queues an update of the run's message
+func (p *runProgress) onStep(name string, result *executor.ExecutionResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.steps {
+		step := &p.steps[i]
+		if step.Name != name {
+			continue
+		}
+		if result == nil && step.Status == "pending" {
+			step.Status = "running"
+			break
+		}
+		if result != nil && (step.Status == "pending" || step.Status == "running") {
+			step.Status = result.Status
+			step.Duration = result.Duration
+			step.ExitCode = result.ExitCode
+			step.Signal = result.Signal
+			break
+		}
+	}
+
+	msg := runMessage(p.req, notify.StatusStarted, p.req.CommitMessage)
+	msg.Progress = true
+	msg.Steps = append([]notify.StepResult(nil), p.steps...)
+	// Updates are queued while holding the lock, so they are sent in order
+	if err := p.sender.Enqueue(p.req.TriggerID, msg); err != nil {
+		logger.LogError("failed to queue progress of run %d: %v", p.req.TriggerID, err)
+	}
+}
@@ -0,0 +1,121 @@
+package http
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/database"
+	"github.com/allintech/github-sentry/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// ReplayDelivery runs an archived webhook delivery again through the same
+// matching and execution path, with dry_run=true it only reports what would run
+func ReplayDelivery(c *gin.Context) {
+	delivery, err := database.GetDelivery(c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.String(http.StatusNotFound, "delivery not found")
+		return
+	}
+	if err != nil {
+		logger.LogError("failed to get delivery %s: %v", c.Param("id"), err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	replay(c, delivery, nil)
+}
+
+// ReplayRun replays the archived delivery that triggered a run, only for the
+// project and environment of that run
+func ReplayRun(c *gin.Context) {
+	triggerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid run id")
+		return
+	}
+
+	trigger, err := database.GetTrigger(triggerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.String(http.StatusNotFound, "run not found")
+		return
+	}
+	if err != nil {
+		logger.LogError("failed to get run %d: %v", triggerID, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	if trigger.DeliveryID == "" {
+		c.String(http.StatusConflict, "run has no delivery id")
+		return
+	}
+
+	delivery, err := database.GetDelivery(trigger.DeliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.String(http.StatusNotFound, "delivery of run not archived")
+		return
+	}
+	if err != nil {
+		logger.LogError("failed to get delivery %s: %v", trigger.DeliveryID, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	replay(c, delivery, trigger)
+}
+
+// replay dispatches an archived delivery, replays always run even though the delivery was seen before
+// With only set, just the project and environment of that run are run again
+func replay(c *gin.Context, delivery *database.Delivery, only *database.Trigger) {
+	cfgInterface, exists := c.Get("config")
+	if !exists {
+		logger.LogError("config not found in context")
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	cfg, ok := cfgInterface.(*config.Config)
+	if !ok {
+		logger.LogError("invalid config type in context")
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	runQueue, ok := queueFromContext(c)
+	if !ok {
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+	sender, ok := outboxFromContext(c)
+	if !ok {
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid dry_run")
+		return
+	}
+
+	logger.LogInfo("replaying delivery %s (%s event, dry run: %t)", delivery.DeliveryID, delivery.Event, dryRun)
+	result := dispatch(cfg, runQueue, sender, delivery.Event, delivery.Payload, dispatchOptions{
+		DeliveryID: delivery.DeliveryID,
+		HookID:     delivery.HookID,
+		Force:      true,
+		DryRun:     dryRun,
+		Only:       only,
+	})
+
+	runs := result.Runs
+	if runs == nil {
+		runs = []dispatchRun{}
+	}
+	c.JSON(result.Status, gin.H{
+		"delivery_id": delivery.DeliveryID,
+		"event":       delivery.Event,
+		"received_at": delivery.ReceivedAt,
+		"message":     result.Message,
+		"runs":        runs,
+		"dry_run":     dryRun,
+	})
+}
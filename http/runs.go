@@ -0,0 +1,184 @@
+package http
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/allintech/github-sentry/database"
+	"github.com/allintech/github-sentry/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// maxLogChunks limits how many log chunks a single request returns
+const maxLogChunks = 100
+
+// maxRuns limits how many runs a single request lists
+const maxRuns = 100
+
+// Runs lists the most recent runs, optionally filtered by the "project" and
+// "environment" query parameters
+func Runs(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		c.String(http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > maxRuns {
+		limit = maxRuns
+	}
+
+	triggers, err := database.ListTriggers(c.Query("project"), c.Query("environment"), limit)
+	if err != nil {
+		logger.LogError("failed to list runs: %v", err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	items := make([]gin.H, 0, len(triggers))
+	for _, trigger := range triggers {
+		items = append(items, gin.H{
+			"run_id":         trigger.ID,
+			"project":        trigger.Project,
+			"environment":    trigger.Environment,
+			"ref_type":       trigger.RefType,
+			"branch":         trigger.Branch,
+			"tag":            trigger.Tag,
+			"release_name":   trigger.ReleaseName,
+			"pr_number":      trigger.PRNumber,
+			"commit_id":      trigger.CommitID,
+			"commit_message": trigger.CommitMessage,
+			"status":         trigger.Status,
+			"skip_reason":    trigger.SkipReason,
+			"created_at":     trigger.CreatedAt,
+			"finished_at":    trigger.FinishedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": items})
+}
+
+// Run returns a summary of a run with the status of every step, GitHub statuses link here
+// It is public, so it leaves out step commands, errors and output, which may
+// contain secrets; RunLogs returns the output to API token holders
+func Run(c *gin.Context) {
+	triggerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid run id")
+		return
+	}
+
+	trigger, err := database.GetTrigger(triggerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.String(http.StatusNotFound, "run not found")
+		return
+	}
+	if err != nil {
+		logger.LogError("failed to get run %d: %v", triggerID, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	executions, err := database.GetExecutions(triggerID)
+	if err != nil {
+		logger.LogError("failed to get steps of run %d: %v", triggerID, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	// Only the steps of the last attempt are returned
+	runAttempt := 1
+	steps := make([]gin.H, 0, len(executions))
+	for _, execution := range executions {
+		runAttempt = execution.RunAttempt
+		steps = append(steps, gin.H{
+			"name":          execution.StepName,
+			"status":        execution.Status,
+			"exit_code":     execution.ExitCode,
+			"signal":        execution.Signal,
+			"attempts":      execution.Attempts,
+			"allow_failure": execution.AllowFailure,
+			"executed_at":   execution.ExecutedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run_id":         trigger.ID,
+		"project":        trigger.Project,
+		"environment":    trigger.Environment,
+		"ref_type":       trigger.RefType,
+		"branch":         trigger.Branch,
+		"tag":            trigger.Tag,
+		"release_name":   trigger.ReleaseName,
+		"pr_number":      trigger.PRNumber,
+		"commit_id":      trigger.CommitID,
+		"commit_message": trigger.CommitMessage,
+		"delivery_id":    trigger.DeliveryID,
+		"forced":         trigger.Forced,
+		"status":         trigger.Status,
+		"skip_reason":    trigger.SkipReason,
+		"changed_files":  trigger.ChangedFiles,
+		"finished":       trigger.Finished(),
+		"created_at":     trigger.CreatedAt,
+		"finished_at":    trigger.FinishedAt,
+		"run_attempt":    runAttempt,
+		"steps":          steps,
+	})
+}
+
+// RunLogs returns the output of a run stored after the chunk id given in the "after" query parameter
+// Clients tail a run by passing next_after back as "after" until finished is true and no chunks are returned
+func RunLogs(c *gin.Context) {
+	triggerID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid run id")
+		return
+	}
+
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid after")
+		return
+	}
+
+	trigger, err := database.GetTrigger(triggerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.String(http.StatusNotFound, "run not found")
+		return
+	}
+	if err != nil {
+		logger.LogError("failed to get run %d: %v", triggerID, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	chunks, err := database.GetLogChunks(triggerID, after, maxLogChunks)
+	if err != nil {
+		logger.LogError("failed to get logs of run %d: %v", triggerID, err)
+		c.String(http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	nextAfter := after
+	items := make([]gin.H, 0, len(chunks))
+	for _, chunk := range chunks {
+		items = append(items, gin.H{
+			"id":            chunk.ID,
+			"content":       chunk.Content,
+			"line_count":    chunk.LineCount,
+			"first_line_at": chunk.FirstLineAt,
+			"last_line_at":  chunk.LastLineAt,
+		})
+		nextAfter = chunk.ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run_id":      trigger.ID,
+		"environment": trigger.Environment,
+		"status":      trigger.Status,
+		"finished":    trigger.Finished(),
+		"next_after":  nextAfter,
+		"chunks":      items,
+	})
+}
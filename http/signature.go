@@ -0,0 +1,71 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/google/go-github/v62/github"
+)
+
+// payloadRepository is the part of a webhook payload that selects its secret
+type payloadRepository struct {
+	Repository struct {
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
+// validatePayload reads a webhook request and checks its signature against the
+// secrets configured for the repository it is about, returning the JSON payload
+// During a rotation both the new and the previous secret are accepted
+func validatePayload(r *http.Request, cfg *config.Config) ([]byte, error) {
+	signature := r.Header.Get(github.SHA256SignatureHeader)
+	if signature == "" {
+		signature = r.Header.Get(github.SHA1SignatureHeader)
+	}
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	// The repository picks the secret, so the payload is read before its signature is checked
+	unverified, err := github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var target payloadRepository
+	if err := json.Unmarshal(unverified, &target); err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %w", err)
+	}
+	orgName := target.Repository.Owner.Login
+	if orgName == "" {
+		orgName = target.Organization.Login
+	}
+	repoName := target.Repository.Name
+
+	secrets := cfg.WebhookSecrets(orgName, repoName, time.Now())
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no webhook secret configured for %s/%s", orgName, repoName)
+	}
+	for _, secret := range secrets {
+		if payload, err := github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), signature, []byte(secret)); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("signature of %s/%s webhook matches no configured secret", orgName, repoName)
+}
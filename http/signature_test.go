@@ -0,0 +1,84 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+// newWebhookRequest builds a push webhook for owner/repo signed with secret, unsigned if secret is empty
+func newWebhookRequest(owner, repo, secret string) *http.Request {
+	body := `{"repository":{"name":"` + repo + `","owner":{"login":"` + owner + `"}}}`
+	r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return r
+}
+
+func TestValidatePayload(t *testing.T) {
+	now := time.Now()
+	cfg := &config.Config{
+		GitHubWebhookSecret: config.WebhookSecretConfig{Secret: "global"},
+		WebhookSecretsByOrg: map[string]config.WebhookSecretConfig{
+			// Viper lowercases map keys
+			"acme":    {Secret: "org-new", PreviousSecret: "org-old", PreviousExpiresAt: now.Add(time.Hour)},
+			"expired": {Secret: "expired-new", PreviousSecret: "expired-old", PreviousExpiresAt: now.Add(-time.Hour)},
+		},
+		Commands: map[string]config.CommandsConfig{
+			"api":    {Organization: "Acme", Repo: "api", WebhookSecret: config.WebhookSecretConfig{Secret: "api-secret"}},
+			"worker": {Organization: "Acme", Repo: "api", WebhookSecret: config.WebhookSecretConfig{Secret: "worker-secret"}},
+			"site":   {Organization: "Acme", Repo: "site"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		owner  string
+		repo   string
+		secret string
+		valid  bool
+	}{
+		{"project secret", "Acme", "api", "api-secret", true},
+		{"secret of another project of the repo", "Acme", "api", "worker-secret", true},
+		{"org secret not accepted when the project has one", "Acme", "api", "org-new", false},
+		{"org secret for a project without one", "Acme", "site", "org-new", true},
+		{"org lookup is case-insensitive", "ACME", "site", "org-new", true},
+		{"previous org secret during rotation", "Acme", "site", "org-old", true},
+		{"previous secret after expiry", "Expired", "repo", "expired-old", false},
+		{"current secret after expiry", "Expired", "repo", "expired-new", true},
+		{"global secret not accepted for an org with one", "Acme", "site", "global", false},
+		{"global secret for other orgs", "Other", "repo", "global", true},
+		{"wrong secret", "Other", "repo", "guess", false},
+		{"unsigned", "Other", "repo", "", false},
+	}
+	for _, tt := range tests {
+		_, err := validatePayload(newWebhookRequest(tt.owner, tt.repo, tt.secret), cfg)
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: payload validated, want an error", tt.name)
+		}
+	}
+}
+
+func TestValidatePayloadWithoutSecret(t *testing.T) {
+	cfg := &config.Config{
+		WebhookSecretsByOrg: map[string]config.WebhookSecretConfig{"acme": {Secret: "org"}},
+	}
+	_, err := validatePayload(newWebhookRequest("Other", "repo", "anything"), cfg)
+	if err == nil || !strings.Contains(err.Error(), "no webhook secret configured") {
+		t.Errorf("validatePayload() error = %v, want no webhook secret configured", err)
+	}
+}
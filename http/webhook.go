@@ -1,16 +1,25 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/allintech/github-sentry/checks"
 	"github.com/allintech/github-sentry/config"
 	"github.com/allintech/github-sentry/database"
 	"github.com/allintech/github-sentry/executor"
 	"github.com/allintech/github-sentry/logger"
 	"github.com/allintech/github-sentry/notify"
+	"github.com/allintech/github-sentry/outbox"
+	"github.com/allintech/github-sentry/queue"
+	"github.com/allintech/github-sentry/runlog"
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v62/github"
 )
@@ -40,152 +49,671 @@ func WebHook(c *gin.Context) {
 		return
 	}
 
-	// Validate payload
-	payload, err := github.ValidatePayload(c.Request, []byte(cfg.GitHubWebhookSecret))
+	// Validate payload with the secret of its repository
+	payload, err := validatePayload(c.Request, cfg)
 	if err != nil {
 		logger.LogError("invalid payload: %v", err)
 		c.String(http.StatusBadRequest, "invalid payload")
 		return
 	}
 
-	// Parse webhook event
-	event, err := github.ParseWebHook(github.WebHookType(c.Request), payload)
-	if err != nil {
-		logger.LogError("failed to parse webhook: %v", err)
-		c.String(http.StatusBadRequest, "invalid event")
+	runQueue, ok := queueFromContext(c)
+	if !ok {
+		c.String(http.StatusInternalServerError, "internal error")
 		return
 	}
-
-	// Handle push events only
-	pushEvent, ok := event.(*github.PushEvent)
+	sender, ok := outboxFromContext(c)
 	if !ok {
-		logger.LogInfo("ignoring non-push event: %s", github.WebHookType(c.Request))
-		c.String(http.StatusOK, "event ignored")
+		c.String(http.StatusInternalServerError, "internal error")
 		return
 	}
 
-	// Check if this is a push to the staging branch
-	branch := strings.TrimPrefix(pushEvent.GetRef(), "refs/heads/")
-	if branch != cfg.StagingBranch {
-		logger.LogInfo("ignoring push to branch: %s (expected: %s)", branch, cfg.StagingBranch)
-		c.String(http.StatusOK, "branch ignored")
-		return
+	// Keep the validated request so it can be replayed later
+	deliveryID := github.DeliveryID(c.Request)
+	hookID := c.GetHeader("X-GitHub-Hook-ID")
+	if _, err := database.ArchiveDelivery(database.Delivery{
+		DeliveryID: deliveryID,
+		HookID:     hookID,
+		Event:      github.WebHookType(c.Request),
+		Headers:    archivedHeaders(c.Request.Header),
+		Payload:    payload,
+	}); err != nil {
+		logger.LogError("failed to archive delivery %s: %v", deliveryID, err)
 	}
 
-	// Extract commit information from the head commit
-	headCommit := pushEvent.GetHeadCommit()
-	if headCommit == nil {
-		logger.LogInfo("push event has no head commit")
-		c.String(http.StatusOK, "no head commit")
-		return
-	}
+	result := dispatch(cfg, runQueue, sender, github.WebHookType(c.Request), payload, dispatchOptions{
+		DeliveryID: deliveryID,
+		HookID:     hookID,
+	})
 
-	commitID := headCommit.GetID()
-	commitMessage := headCommit.GetMessage()
-	commitTime := headCommit.GetTimestamp().Time
+	// Respond to GitHub immediately, script execution happens in the queue worker
+	c.String(result.Status, result.Message)
+}
 
-	logger.LogTrigger(commitID, commitMessage, branch)
+// dispatchOptions tells dispatch where an event came from and how to handle it
+type dispatchOptions struct {
+	DeliveryID string
+	HookID     string
+	Force      bool // run even if the delivery was seen before, only set by the replay API
+	DryRun     bool // only report what would run
+	// Only restricts the run to one project and environment, as recorded on the
+	// run being replayed; nil runs every matching project
+	Only *database.Trigger
+}
+
+// dispatchResult is what dispatch did with an event
+type dispatchResult struct {
+	Status  int
+	Message string
+	Runs    []dispatchRun // one per matching project, in project name order
+}
+
+// dispatchRun is what dispatch did for one matching project
+type dispatchRun struct {
+	Project     string `json:"project"`
+	Environment string `json:"environment"`
+	Message     string `json:"message"`
+	RunID       int64  `json:"run_id,omitempty"`
+	JobID       int64  `json:"job_id,omitempty"`
+}
+
+// projectMatch is a project selected by the repo and ref of a run
+type projectMatch struct {
+	Name        string
+	Environment string
+	Commands    config.CommandsConfig
+}
+
+// dispatch matches a validated webhook payload against the configured projects
+// and records and queues a run for every matching project, so that several
+// projects of one repository (e.g. the backend and frontend of a monorepo) each
+// get their own run and notifications; webhooks and replays both go through it
+func dispatch(cfg *config.Config, runQueue *queue.Manager, sender *outbox.Sender, eventType string, payload []byte, opts dispatchOptions) dispatchResult {
+	// Parse webhook event
+	event, err := github.ParseWebHook(eventType, payload)
+	if err != nil {
+		logger.LogError("failed to parse webhook: %v", err)
+		return dispatchResult{Status: http.StatusBadRequest, Message: "invalid event"}
+	}
 
-	// Extract repo information
-	repo := pushEvent.GetRepo()
-	orgName := ""
-	repoName := ""
-	if repo != nil {
-		if owner := repo.GetOwner(); owner != nil {
-			orgName = owner.GetLogin()
+	// Branch and tag pushes, published releases and pull requests can trigger runs
+	var req *runRequest
+	var ignored string
+	switch event := event.(type) {
+	case *github.PushEvent:
+		req, ignored = requestFromPush(event)
+	case *github.ReleaseEvent:
+		req, ignored = requestFromRelease(event)
+	case *github.PullRequestEvent:
+		req, ignored = requestFromPullRequest(event)
+	default:
+		logger.LogInfo("ignoring event: %s", eventType)
+		return dispatchResult{Status: http.StatusOK, Message: "event ignored"}
+	}
+	if req == nil {
+		logger.LogInfo("ignoring %s event: %s", eventType, ignored)
+		return dispatchResult{Status: http.StatusOK, Message: "event ignored"}
+	}
+	req.DeliveryID = opts.DeliveryID
+	req.HookID = opts.HookID
+	req.Forced = opts.Force
+
+	// Look up the projects by organization, repo and their branch, tag or release patterns
+	// Pushes of unconfigured repos to the staging branch are still recorded as skipped
+	matches := findProjects(cfg, req)
+	if opts.Only != nil {
+		matches = filterMatches(matches, opts.Only.Project, opts.Only.Environment)
+		if len(matches) == 0 && opts.Only.Project != "" {
+			logger.LogInfo("project %s no longer runs for %s %s", opts.Only.Project, req.RefType, req.refName())
+			return dispatchResult{Status: http.StatusConflict, Message: "project of run no longer matches the delivery"}
+		}
+	}
+	if len(matches) == 0 {
+		if repoConfigured(cfg, req.OrgName, req.RepoName) || req.RefType != config.RefBranch || req.Branch != cfg.StagingBranch {
+			logger.LogInfo("ignoring %s %s (no project of %s deploys from it)", req.RefType, req.refName(), req.FullRepoName)
+			return dispatchResult{Status: http.StatusOK, Message: req.RefType + " ignored"}
 		}
-		repoName = repo.GetName()
+		logger.LogInfo("no commands configured for project %s (org: %s, repo: %s), skipping execution", req.FullRepoName, req.OrgName, req.RepoName)
 	}
 
-	// Build full repo name for display/logging purposes
-	fullRepoName := orgName + "/" + repoName
-	if fullRepoName == "/" {
-		fullRepoName = "unknown/repo"
-		orgName = "unknown"
-		repoName = "repo"
+	if !opts.DryRun {
+		logger.LogTrigger(req.CommitID, req.CommitMessage, req.refName())
 	}
 
-	// Get commit author (prefer committer, fallback to pusher)
-	author := headCommit.GetAuthor().GetName()
-	if author == "" {
-		author = headCommit.GetAuthor().GetLogin()
+	result := dispatchResult{Status: http.StatusOK, Message: "webhook received"}
+	if opts.DryRun {
+		result.Message = "dry run"
 	}
-	if author == "" {
-		author = pushEvent.GetPusher().GetName()
+	if len(matches) == 0 {
+		run, status := dispatchProject(cfg, runQueue, sender, *req, nil, opts)
+		result.Runs = append(result.Runs, run)
+		result.Status = status
+		return result
 	}
-	if author == "" {
-		author = pushEvent.GetPusher().GetLogin()
+
+	duplicates := 0
+	for i := range matches {
+		run, status := dispatchProject(cfg, runQueue, sender, *req, &matches[i], opts)
+		result.Runs = append(result.Runs, run)
+		if status != http.StatusOK {
+			// Projects already recorded are not run twice when GitHub redelivers
+			result.Status = status
+			result.Message = "failed to queue some runs"
+		}
+		if run.Message == "duplicate delivery ignored" {
+			duplicates++
+		}
 	}
-	if author == "" {
-		author = "unknown"
+	if duplicates == len(matches) {
+		result.Message = "duplicate delivery ignored"
 	}
+	return result
+}
 
-	// Send "started" card notification immediately
-	if notifyErr := notify.NotifyWithSecret(cfg.Feishu.WebhookURL, cfg.Feishu.WebhookSecret, notify.StatusStarted, fullRepoName, author, commitID, commitMessage, branch, commitTime); notifyErr != nil {
-		logger.LogError("failed to send Feishu started notification: %v", notifyErr)
-		// Continue processing even if notification fails
+// filterMatches returns the matches of one project and environment
+func filterMatches(matches []projectMatch, project, environment string) []projectMatch {
+	filtered := make([]projectMatch, 0, 1)
+	for _, match := range matches {
+		if match.Name == project && match.Environment == environment {
+			filtered = append(filtered, match)
+		}
+	}
+	return filtered
+}
+
+// dispatchProject records and queues the run of one matching project, or the
+// skipped run of an unconfigured repo when match is nil
+func dispatchProject(cfg *config.Config, runQueue *queue.Manager, sender *outbox.Sender, req runRequest, match *projectMatch, opts dispatchOptions) (dispatchRun, int) {
+	// Skip markers and actor filters still record the run, as skipped
+	skipReason := "no commands configured"
+	var projectCommands config.CommandsConfig
+	if match != nil {
+		req.ProjectName = match.Name
+		req.Environment = match.Environment
+		projectCommands = match.Commands
+		skipReason = projectCommands.SkipReason(req.Environment, req.RefType, req.CommitMessage, req.Pusher, req.Sender)
+	}
+	run := dispatchRun{Project: req.ProjectName, Environment: req.Environment}
+
+	if opts.DryRun {
+		run.Message = "would run"
+		if skipReason != "" {
+			run.Message = "would skip (" + skipReason + ")"
+		}
+		return run, http.StatusOK
 	}
 
 	// Record trigger in database
-	triggerID, err := database.RecordTrigger(commitTime, commitID, commitMessage, branch)
+	triggerID, err := database.RecordTrigger(database.Trigger{
+		Time:          req.CommitTime,
+		CommitID:      req.CommitID,
+		CommitMessage: req.CommitMessage,
+		Branch:        req.Branch,
+		RefType:       req.RefType,
+		Tag:           req.Tag,
+		ReleaseName:   req.ReleaseName,
+		PRNumber:      req.PRNumber,
+		PRTitle:       req.PRTitle,
+		PRAction:      req.PRAction,
+		PRAuthor:      req.PRAuthor,
+		BaseRef:       req.BaseRef,
+		HeadRef:       req.HeadRef,
+		Project:       req.ProjectName,
+		Environment:   req.Environment,
+		DeliveryID:    req.DeliveryID,
+		HookID:        req.HookID,
+		Forced:        req.Forced,
+		ChangedFiles:  req.ChangedFiles,
+	})
+	if errors.Is(err, database.ErrDuplicateDelivery) {
+		// GitHub retried or someone hit "Redeliver", the run already exists
+		logger.LogInfo("ignoring duplicate delivery %s for project %s, replay the delivery to run it again", req.DeliveryID, req.ProjectName)
+		run.Message = "duplicate delivery ignored"
+		return run, http.StatusOK
+	}
 	if err != nil {
 		logger.LogError("failed to record trigger: %v", err)
-		c.String(http.StatusInternalServerError, "failed to record trigger")
-		return
+		run.Message = "failed to record trigger"
+		return run, http.StatusInternalServerError
+	}
+	req.TriggerID = triggerID
+	run.RunID = triggerID
+
+	if skipReason != "" {
+		run.Message = "skipped: " + skipReason
+		go skipRun(sender, &req, skipReason)
+		return run, http.StatusOK
+	}
+
+	if req.Environment != "" {
+		logger.LogInfo("matched project %s environment %s for org=%s, repo=%s, %s=%s", req.ProjectName, req.Environment, req.OrgName, req.RepoName, req.RefType, req.refName())
+	} else {
+		logger.LogInfo("matched project %s for org=%s, repo=%s", req.ProjectName, req.OrgName, req.RepoName)
 	}
 
-	// Respond to GitHub immediately with success
-	// Script execution will happen asynchronously in the background
-	c.String(http.StatusOK, "webhook received")
+	// Store the run in the job queue before acknowledging the webhook, so it survives restarts
+	// Runs of the same concurrency group execute one at a time
+	jobPayload, err := json.Marshal(req)
+	if err != nil {
+		logger.LogError("failed to encode run: %v", err)
+		run.Message = "internal error"
+		return run, http.StatusInternalServerError
+	}
+	group := projectCommands.Concurrency.Group
+	if req.RefType == config.RefPullRequest {
+		// Checks of a pull request only wait for earlier checks of the same pull request
+		group = group + "/pull/" + strconv.Itoa(req.PRNumber)
+	}
+	jobID, err := runQueue.Enqueue(triggerID, group, queue.Policy(projectCommands.Concurrency.Policy), jobPayload)
+	if err != nil {
+		logger.LogError("failed to enqueue run %d: %v", triggerID, err)
+		run.Message = "failed to enqueue run"
+		return run, http.StatusInternalServerError
+	}
+	logger.LogInfo("queued run %d as job %d in group %s", triggerID, jobID, group)
+	run.Message = "queued"
+	run.JobID = jobID
+	return run, http.StatusOK
+}
 
-	// Launch async processing in background goroutine
-	go processWebhookAsync(cfg, triggerID, commitID, commitMessage, branch, fullRepoName, orgName, repoName, author, commitTime)
+// queueFromContext returns the run queue injected into the gin context
+func queueFromContext(c *gin.Context) (*queue.Manager, bool) {
+	queueInterface, exists := c.Get("queue")
+	if !exists {
+		logger.LogError("queue not found in context")
+		return nil, false
+	}
+	runQueue, ok := queueInterface.(*queue.Manager)
+	if !ok {
+		logger.LogError("invalid queue type in context")
+		return nil, false
+	}
+	return runQueue, true
 }
 
-// processWebhookAsync handles script execution, result recording, and notifications asynchronously
-// This function runs in a background goroutine and does not affect the HTTP response
-func processWebhookAsync(cfg *config.Config, triggerID int64, commitID, commitMessage, branch, fullRepoName, orgName, repoName, author string, commitTime time.Time) {
-	// Look up commands for this specific project by matching organization and repo
-	var projectCommands config.CommandsConfig
-	var projectName string
-	found := false
-
-	if cfg.Commands != nil {
-		for name, commands := range cfg.Commands {
-			if commands.Organization == orgName && commands.Repo == repoName {
-				projectCommands = commands
-				projectName = name
-				found = true
-				break
+// outboxFromContext returns the notification sender injected into the gin context
+func outboxFromContext(c *gin.Context) (*outbox.Sender, bool) {
+	senderInterface, exists := c.Get("outbox")
+	if !exists {
+		logger.LogError("outbox not found in context")
+		return nil, false
+	}
+	sender, ok := senderInterface.(*outbox.Sender)
+	if !ok {
+		logger.LogError("invalid outbox type in context")
+		return nil, false
+	}
+	return sender, true
+}
+
+// archivedHeaders returns the request headers worth keeping with a delivery,
+// credentials a proxy may have added are dropped
+func archivedHeaders(header http.Header) http.Header {
+	archived := header.Clone()
+	archived.Del("Authorization")
+	archived.Del("Cookie")
+	return archived
+}
+
+// runRequest carries everything a queued run needs once it is its turn
+// It is stored as the job payload, the project itself is looked up again when
+// the run starts so that jobs queued before a config change use the new config
+type runRequest struct {
+	TriggerID     int64                 `json:"trigger_id"`
+	ProjectName   string                `json:"project_name"`
+	Environment   string                `json:"environment"`
+	Project       config.CommandsConfig `json:"-"`
+	CommitID      string                `json:"commit_id"`
+	CommitMessage string                `json:"commit_message"`
+	Branch        string                `json:"branch"`
+	RefType       string                `json:"ref_type"`
+	Tag           string                `json:"tag"`
+	ReleaseName   string                `json:"release_name"`
+	ReleaseNotes  string                `json:"release_notes"`
+	PRNumber      int                   `json:"pr_number"`
+	PRTitle       string                `json:"pr_title"`
+	PRAction      string                `json:"pr_action"`
+	PRAuthor      string                `json:"pr_author"`
+	PRMerged      bool                  `json:"pr_merged"`
+	BaseRef       string                `json:"base_ref"`
+	HeadRef       string                `json:"head_ref"`
+	DeliveryID    string                `json:"delivery_id"`
+	HookID        string                `json:"hook_id"`
+	Forced        bool                  `json:"forced"`
+	CheckRunID    int64                 `json:"-"`
+	FullRepoName  string                `json:"full_repo_name"`
+	OrgName       string                `json:"org_name"`
+	RepoName      string                `json:"repo_name"`
+	Author        string                `json:"author"`
+	Pusher        string                `json:"pusher"`        // login of the pusher, empty unless the run is a push
+	Sender        string                `json:"sender"`        // login of the user whose action sent the webhook
+	ChangedFiles  []string              `json:"changed_files"` // files changed by a branch push, nil if unknown
+	CommitTime    time.Time             `json:"commit_time"`
+	QueueWait     time.Duration         `json:"-"` // from queueing the job to claiming it
+	RunAttempt    int                   `json:"-"` // 1 for the first run, higher when the run was requeued
+}
+
+// JobHandler returns the queue handler that runs and reports queued webhook runs
+func JobHandler(cfg *config.Config, sender *outbox.Sender) queue.Handler {
+	return queue.Handler{
+		Run: func(ctx context.Context, job *database.Job) {
+			req, err := decodeRunRequest(job)
+			if err != nil {
+				logger.LogError("failed to decode job %d: %v", job.ID, err)
+				if dbErr := database.FinishTrigger(job.TriggerID, database.TriggerFailed); dbErr != nil {
+					logger.LogError("failed to record run status: %v", dbErr)
+				}
+				return
+			}
+			project, ok := cfg.Commands[req.ProjectName]
+			if !ok {
+				skipRun(sender, req, "project "+req.ProjectName+" is no longer configured")
+				return
+			}
+			if req.RefType == config.RefPullRequest {
+				if !project.PullRequests.Enabled() {
+					skipRun(sender, req, "project "+req.ProjectName+" no longer checks pull requests")
+					return
+				}
+				project = project.ForPullRequest()
+			} else if project, ok = project.ForEnvironment(req.Environment); !ok {
+				skipRun(sender, req, "environment "+req.Environment+" of project "+req.ProjectName+" is no longer configured")
+				return
+			}
+			req.Project = project
+			processWebhookAsync(ctx, cfg, sender, req)
+		},
+		Skip: func(job *database.Job, reason string) {
+			req, err := decodeRunRequest(job)
+			if err != nil {
+				logger.LogError("failed to decode job %d: %v", job.ID, err)
+				return
 			}
+			skipRun(sender, req, reason)
+		},
+		Interrupted: func(job *database.Job, requeued bool) {
+			req, err := decodeRunRequest(job)
+			if err != nil {
+				logger.LogError("failed to decode job %d: %v", job.ID, err)
+				return
+			}
+			interruptRun(sender, req, "the server restarted while it was running", requeued)
+		},
+	}
+}
+
+// decodeRunRequest reads the run stored as a job's payload
+func decodeRunRequest(job *database.Job) (*runRequest, error) {
+	var req runRequest
+	if err := json.Unmarshal(job.Payload, &req); err != nil {
+		return nil, err
+	}
+	req.TriggerID = job.TriggerID
+	req.RunAttempt = job.Attempts
+	if job.ClaimedAt != nil {
+		req.QueueWait = job.ClaimedAt.Sub(job.CreatedAt)
+	}
+	// Jobs queued before tags and releases were supported are branch pushes
+	if req.RefType == "" {
+		req.RefType = config.RefBranch
+	}
+	return &req, nil
+}
+
+// findProjects returns every project, with its environment, configured for the
+// repo and ref of a run, in project name order
+func findProjects(cfg *config.Config, req *runRequest) []projectMatch {
+	names := make([]string, 0, len(cfg.Commands))
+	for name := range cfg.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var matches []projectMatch
+	for _, name := range names {
+		commands := cfg.Commands[name]
+		if commands.Organization != req.OrgName || commands.Repo != req.RepoName {
+			continue
+		}
+		if req.RefType == config.RefPullRequest {
+			if commands.PullRequests.Match(req.PRAction, req.BaseRef) {
+				matches = append(matches, projectMatch{Name: name, Commands: commands})
+			}
+			continue
+		}
+		if environment, ok := commands.Match(req.RefType, req.refName()); ok {
+			if req.RefType == config.RefBranch && !commands.MatchFiles(req.ChangedFiles) {
+				logger.LogInfo("project %s: no changed file matches its paths", name)
+				continue
+			}
+			matches = append(matches, projectMatch{Name: name, Environment: environment, Commands: commands})
 		}
 	}
+	return matches
+}
 
-	if !found {
-		logger.LogInfo("no commands configured for project %s (org: %s, repo: %s), skipping execution", fullRepoName, orgName, repoName)
-		// Send Feishu notification about skipped execution
-		if notifyErr := notify.NotifyWithSecret(cfg.Feishu.WebhookURL, cfg.Feishu.WebhookSecret, notify.StatusSuccess, fullRepoName, author, commitID, commitMessage+" (skipped - no commands configured)", branch, commitTime); notifyErr != nil {
-			logger.LogError("failed to send Feishu notification: %v", notifyErr)
+// repoConfigured reports whether any project is configured for an organization and repo
+func repoConfigured(cfg *config.Config, orgName, repoName string) bool {
+	for _, commands := range cfg.Commands {
+		if commands.Organization == orgName && commands.Repo == repoName {
+			return true
 		}
+	}
+	return false
+}
+
+// notifyRun queues a message about a run in the outbox, for the destinations
+// routed for its project, environment and status
+func notifyRun(sender *outbox.Sender, req *runRequest, status notify.NotificationStatus, message string) error {
+	return sender.Enqueue(req.TriggerID, runMessage(req, status, message))
+}
+
+// notifyResult queues the completion message of a run, with the result of every
+// step, the step that failed it if any, the run duration and how long the run
+// waited in the queue
+func notifyResult(sender *outbox.Sender, req *runRequest, status notify.NotificationStatus, message string, failure *notify.Failure, results []executor.ExecutionResult, duration time.Duration) error {
+	msg := runMessage(req, status, message)
+	msg.Failure = failure
+	msg.Duration = duration
+	msg.QueueWait = req.QueueWait
+	for _, result := range results {
+		msg.Steps = append(msg.Steps, notify.StepResult{
+			Name:         result.StepName,
+			Status:       result.Status,
+			Duration:     result.Duration,
+			ExitCode:     result.ExitCode,
+			Signal:       result.Signal,
+			AllowFailure: result.AllowFailure,
+		})
+	}
+	return sender.Enqueue(req.TriggerID, msg)
+}
+
+// stepFailure describes the step that failed a run for its notification
+// Errors usually end up at the bottom of stderr, so only its tail is kept; steps
+// that wrote nothing to stderr get the tail of their output instead
+func stepFailure(result executor.ExecutionResult) *notify.Failure {
+	const maxStderrLen = 1000
+	stderr := stripANSI(strings.TrimSpace(result.Stderr))
+	if stderr == "" {
+		stderr = stripANSI(strings.TrimSpace(result.Output))
+	}
+	if len(stderr) > maxStderrLen {
+		stderr = "(truncated)..." + stderr[len(stderr)-maxStderrLen:]
+	}
+	return &notify.Failure{
+		Step:     result.StepName,
+		Script:   result.ScriptName,
+		Attempts: result.Attempts,
+		ExitCode: result.ExitCode,
+		Signal:   result.Signal,
+		Error:    stripANSI(result.Error),
+		Stderr:   stderr,
+	}
+}
+
+// runMessage builds the notification message about a run
+func runMessage(req *runRequest, status notify.NotificationStatus, message string) notify.Message {
+	return notify.Message{
+		Status:        status,
+		Repo:          req.FullRepoName,
+		Project:       req.ProjectName,
+		Environment:   req.Environment,
+		Author:        req.Author,
+		CommitID:      req.CommitID,
+		CommitMessage: message,
+		Branch:        req.Branch,
+		Tag:           req.Tag,
+		ReleaseName:   req.ReleaseName,
+		ReleaseNotes:  req.ReleaseNotes,
+		PRNumber:      req.PRNumber,
+		BaseRef:       req.BaseRef,
+		HeadRef:       req.HeadRef,
+		CommitTime:    req.CommitTime,
+	}
+}
+
+// reportRun publishes the state of a run on its commit in GitHub, if enabled
+// Runs of unconfigured repos and runs without a commit are not reported
+func reportRun(req *runRequest, state checks.State, description string) {
+	if !checks.Enabled() || req.ProjectName == "" {
 		return
 	}
+	// Later reports of a run update the check run created by the first one,
+	// also when the run was requeued after a restart
+	if req.CheckRunID == 0 && checks.CheckRuns() {
+		if trigger, err := database.GetTrigger(req.TriggerID); err == nil {
+			req.CheckRunID = trigger.CheckRunID
+		}
+	}
+
+	name := req.ProjectName
+	if req.RefType == config.RefPullRequest {
+		name = name + "/pull-request"
+	} else if req.Environment != "" {
+		name = name + "/" + req.Environment
+	}
+	checkRunID, err := checks.Report(context.Background(), checks.Target{
+		Owner:      req.OrgName,
+		Repo:       req.RepoName,
+		SHA:        req.CommitID,
+		Name:       name,
+		RunID:      req.TriggerID,
+		CheckRunID: req.CheckRunID,
+	}, state, description)
+	if err != nil {
+		logger.LogError("failed to report run %d to GitHub: %v", req.TriggerID, err)
+	}
+	if checkRunID != req.CheckRunID {
+		req.CheckRunID = checkRunID
+		if dbErr := database.SetCheckRunID(req.TriggerID, checkRunID); dbErr != nil {
+			logger.LogError("failed to record check run: %v", dbErr)
+		}
+	}
+}
+
+// skipRun records a run that will not execute and notifies about it
+func skipRun(sender *outbox.Sender, req *runRequest, reason string) {
+	logger.LogInfo("skipping run %d: %s", req.TriggerID, reason)
+	if dbErr := database.SkipTrigger(req.TriggerID, reason); dbErr != nil {
+		logger.LogError("failed to record run status: %v", dbErr)
+	}
+	reportRun(req, checks.StateSkipped, "Skipped: "+reason)
+	// Notify about the skipped execution
+	if notifyErr := notifyRun(sender, req, notify.StatusSkipped, req.CommitMessage+" (skipped - "+reason+")"); notifyErr != nil {
+		logger.LogError("failed to queue notification: %v", notifyErr)
+	}
+}
 
-	logger.LogInfo("matched project %s for org=%s, repo=%s", projectName, orgName, repoName)
+// interruptRun records a run that was stopped before it could finish and notifies about it
+func interruptRun(sender *outbox.Sender, req *runRequest, reason string, requeued bool) {
+	message := req.CommitMessage + " (interrupted - " + reason + ")"
+	if requeued {
+		message = req.CommitMessage + " (interrupted - " + reason + ", queued again)"
+		if dbErr := database.SetTriggerStatus(req.TriggerID, database.TriggerQueued); dbErr != nil {
+			logger.LogError("failed to record run status: %v", dbErr)
+		}
+		reportRun(req, checks.StatePending, "Interrupted, queued again")
+	} else {
+		if dbErr := database.FinishTrigger(req.TriggerID, database.TriggerInterrupted); dbErr != nil {
+			logger.LogError("failed to record run status: %v", dbErr)
+		}
+		reportRun(req, checks.StateCancelled, "Interrupted: "+reason)
+	}
+	if notifyErr := notifyRun(sender, req, notify.StatusInterrupted, message); notifyErr != nil {
+		logger.LogError("failed to queue notification: %v", notifyErr)
+	}
+}
+
+// processWebhookAsync handles script execution, result recording, and notifications asynchronously
+// This function runs in a queue worker goroutine once the run's concurrency group is free
+// and does not affect the HTTP response; ctx is cancelled when the run is superseded
+func processWebhookAsync(ctx context.Context, cfg *config.Config, sender *outbox.Sender, req *runRequest) {
+	if dbErr := database.SetTriggerStatus(req.TriggerID, database.TriggerRunning); dbErr != nil {
+		logger.LogError("failed to record run status: %v", dbErr)
+	}
+	reportRun(req, checks.StatePending, "Running")
+
+	// Send "started" card notification now that the run actually starts
+	if notifyErr := notifyRun(sender, req, notify.StatusStarted, req.CommitMessage); notifyErr != nil {
+		logger.LogError("failed to queue started notification: %v", notifyErr)
+		// Continue processing even if notification fails
+	}
 
 	// Execute commands from config
-	logger.LogInfo("Starting command execution for commit %s", commitID)
+	logger.LogInfo("Starting command execution for commit %s", req.CommitID)
 	executionStartTime := time.Now()
 
+	// Stream step output to the run log file and database while commands run
+	opts := executor.Options{
+		Branch:       req.Branch,
+		Repo:         req.FullRepoName,
+		CommitID:     req.CommitID,
+		RefType:      req.RefType,
+		Tag:          req.Tag,
+		ReleaseName:  req.ReleaseName,
+		ReleaseNotes: req.ReleaseNotes,
+		PullRequest:  req.pullRequest(),
+		Environment:  req.Environment,
+		Env:          req.Project.Environments[req.Environment].Env,
+	}
+	if req.ChangedFiles != nil {
+		if path, err := runlog.WriteChangedFiles(cfg.LogFolder, req.TriggerID, req.ChangedFiles); err != nil {
+			logger.LogError("failed to write changed files of run %d: %v", req.TriggerID, err)
+		} else {
+			opts.ChangedFiles = path
+		}
+	}
+	// Destinations that update their messages in place follow the steps live
+	if progress := newRunProgress(sender, req); progress != nil {
+		opts.OnStep = progress.onStep
+	}
+	runLog, err := runlog.Open(cfg.LogFolder, req.TriggerID)
+	if err != nil {
+		logger.LogError("failed to open run log: %v", err)
+	} else {
+		opts.OnLine = runLog.WriteLine
+	}
+
 	var results []executor.ExecutionResult
-	var err error
-	if len(projectCommands.Sequential) > 0 || len(projectCommands.Async) > 0 {
+	if len(req.Project.Steps) > 0 {
+		// Run steps as a dependency graph
+		results, err = executor.ExecuteGraph(ctx, buildSteps(req.Project, req.Project.Steps), opts)
+	} else if len(req.Project.Sequential) > 0 || len(req.Project.Async) > 0 {
 		// Use new command-based execution
-		results, err = executor.ExecuteCommands(projectCommands.Sequential, projectCommands.Async, branch, fullRepoName)
+		results, err = executor.ExecuteCommands(ctx, buildSteps(req.Project, req.Project.Sequential), buildSteps(req.Project, req.Project.Async), opts)
 	} else {
 		// Fallback to old scripts folder method (deprecated)
 		results, err = executor.ExecuteScripts(cfg.ScriptsFolder)
 	}
 
+	// Flush the remaining output before the run is marked finished, so tailing clients see all of it
+	if runLog != nil {
+		if closeErr := runLog.Close(); closeErr != nil {
+			logger.LogError("failed to close run log: %v", closeErr)
+		}
+	}
+
 	// Calculate execution completion time and duration
 	var executionEndTime time.Time
 	var totalDuration time.Duration
@@ -218,75 +746,161 @@ func processWebhookAsync(cfg *config.Config, triggerID int64, commitID, commitMe
 		logger.LogError("Warning: Some execution results are missing completion times")
 	}
 
+	// Aggregate the run status from every step, an execution error always fails the run
+	runStatus := executor.RunStatus(results)
 	if err != nil {
-		logger.LogError("script execution failed: %v", err)
-		// Record failed executions
-		for _, result := range results {
-			status := "success"
-			if !result.Success {
-				status = "failed"
-			}
-			if dbErr := database.RecordExecution(triggerID, result.ScriptName, status, result.Output, result.Error); dbErr != nil {
-				logger.LogError("failed to record execution: %v", dbErr)
-			}
-			logger.LogExecutionWithTiming(result.ScriptName, result.Success, result.Output, result.Error, result.StartTime, result.EndTime, result.Duration)
+		runStatus = executor.RunFailed
+	}
+	// A run stopped by a server shutdown is interrupted, and one superseded by a
+	// newer run in its concurrency group is cancelled, rather than failed
+	cancelCause := context.Cause(ctx)
+	if errors.Is(cancelCause, queue.ErrShutdown) {
+		recordResults(req, results)
+		interruptRun(sender, req, "the server shut down while it was running", cfg.Queue.RequeueInterrupted)
+		return
+	}
+	if cancelCause != nil {
+		runStatus = database.TriggerCancelled
+	}
+
+	// Record executions and the final run status
+	recordResults(req, results)
+	if dbErr := database.FinishTrigger(req.TriggerID, runStatus); dbErr != nil {
+		logger.LogError("failed to record run status: %v", dbErr)
+	}
+
+	if cancelCause != nil {
+		logger.LogInfo("run %d %v", req.TriggerID, cancelCause)
+		reportRun(req, checks.StateCancelled, cancelCause.Error())
+		if notifyErr := notifyRun(sender, req, notify.StatusCancelled, req.CommitMessage+" ("+cancelCause.Error()+")"); notifyErr != nil {
+			logger.LogError("failed to queue notification: %v", notifyErr)
 		}
+		return
+	}
+
+	if runStatus == executor.RunFailed {
+		logger.LogError("script execution failed: %v", err)
 
-		// Build failure message including reason from first failed result (if any)
-		failureMessage := commitMessage + " (FAILED)"
+		// Build failure message, the first failed required result (if any) is passed along as the reason
+		failureStatus := notify.StatusFailure
+		failureMessage := req.CommitMessage + " (FAILED)"
+		checkState := checks.StateFailure
+		checkDescription := "Failed"
+		var failure *notify.Failure
 		for _, result := range results {
-			if !result.Success {
-				const maxOutputLen = 2000
-				output := stripANSI(result.Output)
-				if len(output) > maxOutputLen {
-					output = output[:maxOutputLen] + "...(truncated)"
+			if !result.Success && result.Required() && result.Status != executor.StatusSkipped {
+				checkDescription = "Step " + result.StepName + " failed"
+				if result.Status == executor.StatusTimeout {
+					failureStatus = notify.StatusTimeout
+					failureMessage = req.CommitMessage + " (TIMED OUT)"
+					checkState = checks.StateTimedOut
+					checkDescription = "Step " + result.StepName + " timed out"
 				}
-				errorMsg := stripANSI(result.Error)
-				failureMessage = failureMessage + "\n\nFailure Reason:\n" +
-					"Script: " + result.ScriptName + "\n" +
-					"Error: " + errorMsg + "\n" +
-					"Output:\n" + output
+				failure = stepFailure(result)
 				break
 			}
 		}
+		skipped := make([]string, 0)
+		for _, result := range results {
+			if result.Status == executor.StatusSkipped {
+				skipped = append(skipped, result.StepName)
+			}
+		}
+		if len(skipped) > 0 {
+			failureMessage = failureMessage + "\n\nSkipped: " + strings.Join(skipped, ", ")
+		}
+		reportRun(req, checkState, checkDescription)
 
-		// Send Feishu notification about failure (with reason)
-		// This is sent synchronously (blocking) immediately after execution completion is verified
+		// Notify about the failure (with reason)
+		// It is queued once execution completion is verified, the outbox delivers it with retries
 		notificationStartTime := time.Now()
-		logger.LogInfo("Sending failure notification at %s", notificationStartTime.Format("2006-01-02 15:04:05.000000"))
-		if notifyErr := notify.NotifyWithSecret(cfg.Feishu.WebhookURL, cfg.Feishu.WebhookSecret, notify.StatusFailure, fullRepoName, author, commitID, failureMessage, branch, commitTime); notifyErr != nil {
-			logger.LogError("failed to send Feishu notification: %v", notifyErr)
+		logger.LogInfo("Queueing failure notification at %s", notificationStartTime.Format("2006-01-02 15:04:05.000000"))
+		if notifyErr := notifyResult(sender, req, failureStatus, failureMessage, failure, results, totalDuration); notifyErr != nil {
+			logger.LogError("failed to queue notification: %v", notifyErr)
 		} else {
 			notificationEndTime := time.Now()
 			notificationDuration := notificationEndTime.Sub(notificationStartTime)
-			logger.LogInfo("Notification sent at %s (duration: %v)", notificationEndTime.Format("2006-01-02 15:04:05.000000"), notificationDuration)
+			logger.LogInfo("Notification queued at %s (duration: %v)", notificationEndTime.Format("2006-01-02 15:04:05.000000"), notificationDuration)
 		}
 		return
 	}
 
-	// Record successful executions
-	for _, result := range results {
-		status := "success"
-		if !result.Success {
-			status = "failed"
-		}
-		if dbErr := database.RecordExecution(triggerID, result.ScriptName, status, result.Output, result.Error); dbErr != nil {
-			logger.LogError("failed to record execution: %v", dbErr)
+	// Optional steps do not fail the run, but their failures make it partial and are called out on the card
+	cardStatus := notify.StatusSuccess
+	successMessage := req.CommitMessage
+	checkDescription := "Succeeded"
+	if runStatus == executor.RunPartial {
+		cardStatus = notify.StatusPartial
+		checkDescription = "Succeeded, optional steps failed"
+		optionalFailures := make([]string, 0)
+		for _, result := range results {
+			if !result.Success {
+				optionalFailures = append(optionalFailures, result.StepName+" ("+result.Status+")")
+			}
 		}
-		logger.LogExecutionWithTiming(result.ScriptName, result.Success, result.Output, result.Error, result.StartTime, result.EndTime, result.Duration)
+		successMessage = successMessage + "\n\nOptional steps failed:\n" + strings.Join(optionalFailures, "\n")
 	}
+	reportRun(req, checks.StateSuccess, checkDescription)
 
-	// Send Feishu notification for success
-	// This is sent synchronously (blocking) immediately after execution completion is verified
+	// Notify about the success
+	// It is queued once execution completion is verified, the outbox delivers it with retries
 	notificationStartTime := time.Now()
-	logger.LogInfo("Sending success notification at %s", notificationStartTime.Format("2006-01-02 15:04:05.000000"))
-	if err := notify.NotifyWithSecret(cfg.Feishu.WebhookURL, cfg.Feishu.WebhookSecret, notify.StatusSuccess, fullRepoName, author, commitID, commitMessage, branch, commitTime); err != nil {
-		logger.LogError("failed to send Feishu notification: %v", err)
+	logger.LogInfo("Queueing %s notification at %s", runStatus, notificationStartTime.Format("2006-01-02 15:04:05.000000"))
+	if err := notifyResult(sender, req, cardStatus, successMessage, nil, results, totalDuration); err != nil {
+		logger.LogError("failed to queue notification: %v", err)
 	} else {
 		notificationEndTime := time.Now()
 		notificationDuration := notificationEndTime.Sub(notificationStartTime)
-		logger.LogInfo("Notification sent at %s (duration: %v)", notificationEndTime.Format("2006-01-02 15:04:05.000000"), notificationDuration)
+		logger.LogInfo("Notification queued at %s (duration: %v)", notificationEndTime.Format("2006-01-02 15:04:05.000000"), notificationDuration)
 	}
 
-	logger.LogInfo("webhook processed successfully for commit %s", commitID)
+	logger.LogInfo("webhook processed with status %s for commit %s", runStatus, req.CommitID)
+}
+
+// buildSteps converts configured steps into executor steps, resolving their timeouts
+func buildSteps(projectCommands config.CommandsConfig, stepConfigs []config.StepConfig) []executor.Step {
+	steps := make([]executor.Step, 0, len(stepConfigs))
+	for _, stepConfig := range stepConfigs {
+		steps = append(steps, executor.Step{
+			Name:         stepConfig.Name,
+			Command:      stepConfig.Command,
+			Dir:          stepConfig.Dir,
+			Env:          stepConfig.Env,
+			Timeout:      projectCommands.TimeoutFor(stepConfig),
+			Retries:      stepConfig.Retries,
+			AllowFailure: stepConfig.AllowFailure,
+			Needs:        stepConfig.Needs,
+		})
+	}
+	return steps
+}
+
+// recordResults stores and logs the result of every executed step
+func recordResults(req *runRequest, results []executor.ExecutionResult) {
+	for _, result := range results {
+		execution := database.Execution{
+			TriggerID:    req.TriggerID,
+			ScriptName:   result.ScriptName,
+			StepName:     result.StepName,
+			Environment:  req.Environment,
+			WorkingDir:   result.Dir,
+			Status:       result.Status,
+			Output:       result.Output,
+			Stdout:       result.Stdout,
+			Stderr:       result.Stderr,
+			Signal:       result.Signal,
+			Error:        result.Error,
+			Attempts:     result.Attempts,
+			AllowFailure: result.AllowFailure,
+			RunAttempt:   req.RunAttempt,
+		}
+		if result.ExitCode >= 0 {
+			exitCode := result.ExitCode
+			execution.ExitCode = &exitCode
+		}
+		if dbErr := database.RecordExecution(execution); dbErr != nil {
+			logger.LogError("failed to record execution: %v", dbErr)
+		}
+		logger.LogExecutionWithTiming(result.StepName, result.Success, result.Output, result.Error, result.StartTime, result.EndTime, result.Duration)
+	}
 }
@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+func init() {
+	Register("dingtalk", func(cfg config.NotifierConfig) (Notifier, error) {
+		return dingTalkNotifier{webhookURL: cfg.URL, secret: cfg.Secret}, nil
+	})
+}
+
+// dingTalkNotifier sends markdown messages to a DingTalk custom robot
+type dingTalkNotifier struct {
+	webhookURL string
+	secret     string // robots with the "sign" security setting
+}
+
+// signDingTalkURL appends the timestamp and signature DingTalk expects to a robot URL
+// sign = urlencode(base64(HMAC-SHA256(key=secret, msg=timestamp + "\n" + secret))), timestamp in milliseconds
+func signDingTalkURL(webhookURL, secret string, now time.Time) (string, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse dingtalk url: %w", err)
+	}
+	timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + secret))
+
+	query := u.Query()
+	query.Set("timestamp", timestamp)
+	query.Set("sign", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (n dingTalkNotifier) Notify(msg Message) error {
+	webhookURL := n.webhookURL
+	if n.secret != "" {
+		var err error
+		if webhookURL, err = signDingTalkURL(n.webhookURL, n.secret, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	title, lines := renderText(msg, func(s string) string { return "**" + s + "**" })
+	body, err := postJSON(webhookURL, map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]interface{}{
+			"title": title,
+			// DingTalk markdown needs blank lines to break lines
+			"text": "### " + title + "\n\n" + strings.Join(lines, "\n\n"),
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return checkErrCode("dingtalk", body)
+}
+
+// checkErrCode checks the errcode of a DingTalk or WeCom robot response
+func checkErrCode(backend string, body []byte) error {
+	var resp struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("%s webhook returned unexpected response: %s", backend, string(body))
+	}
+	if resp.ErrCode != 0 {
+		return fmt.Errorf("%s webhook returned error code %d: %s", backend, resp.ErrCode, resp.ErrMsg)
+	}
+	return nil
+}
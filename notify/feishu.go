@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"time"
+
+	"github.com/allintech/github-sentry/config"
 )
 
 // signFeishuRequest generates a signature for Feishu webhook requests
@@ -27,30 +29,34 @@ func signFeishuRequest(timestamp int64, secret string) (string, error) {
 	return signature, nil
 }
 
-// NotificationStatus represents the status of the notification
-type NotificationStatus string
+// maxReleaseNotes limits how many characters of the release notes are shown on a card
+const maxReleaseNotes = 1000
 
-const (
-	StatusStarted NotificationStatus = "started"
-	StatusSuccess NotificationStatus = "success"
-	StatusFailure NotificationStatus = "failure"
-)
+// maxCardSteps limits how many rows the step table of a card has
+const maxCardSteps = 50
+
+func init() {
+	Register("feishu", func(cfg config.NotifierConfig) (Notifier, error) {
+		return feishuNotifier{webhookURL: cfg.URL, webhookSecret: cfg.Secret}, nil
+	})
+}
 
-// Notify sends a Feishu card notification with commit information
-func Notify(webhookURL string, commitID, commitMessage, branch string, commitTime time.Time) error {
-	return NotifyWithSecret(webhookURL, "", StatusSuccess, "", "", commitID, commitMessage, branch, commitTime)
+// feishuNotifier sends cards to a Feishu custom bot
+type feishuNotifier struct {
+	webhookURL    string
+	webhookSecret string
 }
 
-// NotifyWithSecret sends a Feishu card notification with optional signature
-func NotifyWithSecret(webhookURL, webhookSecret string, status NotificationStatus, repoName, author, commitID, commitMessage, branch string, commitTime time.Time) error {
-	card := buildCard(status, repoName, author, commitID, commitMessage, branch, commitTime)
+// Notify sends a card for msg, signed when the bot has a secret
+func (n feishuNotifier) Notify(msg Message) error {
+	card := buildCard(msg)
 
 	var payload map[string]interface{}
 
-	if webhookSecret != "" {
+	if n.webhookSecret != "" {
 		// Sign the request
 		timestamp := time.Now().Unix()
-		signature, err := signFeishuRequest(timestamp, webhookSecret)
+		signature, err := signFeishuRequest(timestamp, n.webhookSecret)
 		if err != nil {
 			return fmt.Errorf("failed to sign request: %w", err)
 		}
@@ -74,7 +80,7 @@ func NotifyWithSecret(webhookURL, webhookSecret string, status NotificationStatu
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequest("POST", n.webhookURL, bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -87,7 +93,7 @@ func NotifyWithSecret(webhookURL, webhookSecret string, status NotificationStatu
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to send request: %w", withoutURL(err))
 	}
 	defer resp.Body.Close()
 
@@ -116,7 +122,12 @@ func NotifyWithSecret(webhookURL, webhookSecret string, status NotificationStatu
 
 // buildCard creates a Feishu card message with status-based colors and emojis
 // Returns just the card object (without msg_type wrapper)
-func buildCard(status NotificationStatus, repoName, author, commitID, commitMessage, branch string, commitTime time.Time) map[string]interface{} {
+func buildCard(msg Message) map[string]interface{} {
+	status := msg.Status
+	repoName := msg.Repo
+	author := msg.Author
+	environment := msg.Environment
+
 	// Set default values
 	if repoName == "" {
 		repoName = "unknown/repo"
@@ -126,30 +137,47 @@ func buildCard(status NotificationStatus, repoName, author, commitID, commitMess
 	}
 
 	// Determine emoji, color, and status text based on status
-	var emoji, template, statusText string
-	switch status {
-	case StatusStarted:
-		emoji = "🚀"
-		template = "blue"
-		statusText = "Workflow Started"
-	case StatusSuccess:
-		emoji = "✅"
-		template = "green"
-		statusText = "Success"
-	case StatusFailure:
-		emoji = "🚨"
-		template = "red"
-		statusText = "Failure"
-	default:
-		emoji = "ℹ️"
-		template = "blue"
-		statusText = "Notification"
+	emoji, template, statusText := statusStyle(status)
+	if msg.Progress {
+		done := 0
+		for _, step := range msg.Steps {
+			if step.Status != "pending" && step.Status != "running" {
+				done++
+			}
+		}
+		statusText = fmt.Sprintf("Running (%d/%d steps done)", done, len(msg.Steps))
 	}
 
-	// Build title with emoji and repo name
+	// Build title with emoji, repo name and the branch or tag
+	ref, refLabel := refOf(msg)
 	title := fmt.Sprintf("%s %s", emoji, repoName)
-	if branch != "" {
-		title = fmt.Sprintf("%s %s - %s", emoji, repoName, branch)
+	if ref != "" {
+		title = fmt.Sprintf("%s %s - %s", emoji, repoName, ref)
+	}
+	if environment != "" {
+		title = fmt.Sprintf("%s [%s]", title, environment)
+	}
+
+	summary := fmt.Sprintf("**Status:** %s\n**Author:** %s\n**%s:** %s", statusText, author, refLabel, ref)
+	if msg.Project != "" {
+		summary += fmt.Sprintf("\n**Project:** %s", msg.Project)
+	}
+	if msg.ReleaseName != "" {
+		summary += fmt.Sprintf("\n**Release:** %s", msg.ReleaseName)
+	}
+	if msg.PRNumber > 0 {
+		summary += fmt.Sprintf("\n**Merge:** %s → %s", msg.HeadRef, msg.BaseRef)
+	}
+
+	details := fmt.Sprintf("**Time:** %s", time.Now().Format("2006-01-02 15:04:05"))
+	if msg.CommitID != "" {
+		details = fmt.Sprintf("**Commit ID:** `%s`\n%s", msg.CommitID, details)
+	}
+	if msg.Duration > 0 {
+		details += fmt.Sprintf("\n**Duration:** %s", formatDuration(msg.Duration))
+	}
+	if msg.QueueWait > 0 {
+		details += fmt.Sprintf("\n**Queue Wait:** %s", formatDuration(msg.QueueWait))
 	}
 
 	// Build elements
@@ -158,7 +186,7 @@ func buildCard(status NotificationStatus, repoName, author, commitID, commitMess
 			"tag": "div",
 			"text": map[string]interface{}{
 				"tag":     "lark_md",
-				"content": fmt.Sprintf("**Status:** %s\n**Author:** %s\n**Branch:** %s", statusText, author, branch),
+				"content": summary,
 			},
 		},
 		{
@@ -168,19 +196,63 @@ func buildCard(status NotificationStatus, repoName, author, commitID, commitMess
 			"tag": "div",
 			"text": map[string]interface{}{
 				"tag":     "lark_md",
-				"content": fmt.Sprintf("**Commit ID:** `%s`\n**Time:** %s", commitID, time.Now().Format("2006-01-02 15:04:05")),
+				"content": details,
 			},
 		},
-		{
+	}
+
+	if len(msg.Steps) > 0 {
+		elements = append(elements, map[string]interface{}{
+			"tag": "hr",
+		})
+		elements = append(elements, buildStepTable(msg.Steps)...)
+	}
+
+	if msg.Failure != nil {
+		elements = append(elements,
+			map[string]interface{}{
+				"tag": "hr",
+			},
+			map[string]interface{}{
+				"tag": "div",
+				"text": map[string]interface{}{
+					"tag":     "lark_md",
+					"content": failureText(msg.Failure, func(s string) string { return "**" + s + "**" }),
+				},
+			},
+		)
+	}
+
+	elements = append(elements,
+		map[string]interface{}{
 			"tag": "hr",
 		},
-		{
+		map[string]interface{}{
 			"tag": "div",
 			"text": map[string]interface{}{
 				"tag":     "lark_md",
-				"content": fmt.Sprintf("**Commit Message:**\n%s", commitMessage),
+				"content": fmt.Sprintf("**Commit Message:**\n%s", msg.CommitMessage),
 			},
 		},
+	)
+
+	if msg.ReleaseNotes != "" {
+		notes := msg.ReleaseNotes
+		if runes := []rune(notes); len(runes) > maxReleaseNotes {
+			notes = string(runes[:maxReleaseNotes]) + "..."
+		}
+		elements = append(elements,
+			map[string]interface{}{
+				"tag": "hr",
+			},
+			map[string]interface{}{
+				"tag": "div",
+				"text": map[string]interface{}{
+					"tag":     "lark_md",
+					"content": fmt.Sprintf("**Release Notes:**\n%s", notes),
+				},
+			},
+		)
 	}
 
 	// Feishu card format - just the card object
@@ -202,86 +274,64 @@ func buildCard(status NotificationStatus, repoName, author, commitID, commitMess
 	return card
 }
 
-// NotifyStarted sends a simple text notification when workflow starts
-// This is a lightweight notification sent immediately when webhook is triggered
-func NotifyStarted(webhookURL, webhookSecret, repoName, actor, commitMessage string) error {
-	// Truncate commit message to 200 chars
-	commitMsgShort := commitMessage
-	if len(commitMsgShort) > 200 {
-		commitMsgShort = commitMsgShort[:200]
+// buildStepTable renders step results as rows of a header and one column set per step
+func buildStepTable(steps []StepResult) []map[string]interface{} {
+	rows := []map[string]interface{}{
+		stepRow("**Step**", "**Status**", "**Duration**", "**Exit Code**"),
 	}
-
-	textContent := fmt.Sprintf("🚀 %s updated %s about %s", actor, repoName, commitMsgShort)
-
-	var payload map[string]interface{}
-
-	if webhookSecret != "" {
-		// Sign the request
-		timestamp := time.Now().Unix()
-		signature, err := signFeishuRequest(timestamp, webhookSecret)
-		if err != nil {
-			return fmt.Errorf("failed to sign request: %w", err)
+	for i, step := range steps {
+		if i == maxCardSteps {
+			rows = append(rows, map[string]interface{}{
+				"tag": "div",
+				"text": map[string]interface{}{
+					"tag":     "lark_md",
+					"content": fmt.Sprintf("...and %d more steps", len(steps)-maxCardSteps),
+				},
+			})
+			break
 		}
-
-		payload = map[string]interface{}{
-			"timestamp": timestamp,
-			"sign":      signature,
-			"msg_type":  "text",
-			"content": map[string]interface{}{
-				"text": textContent,
-			},
+		status := stepIcon(step) + " " + step.Status
+		if step.AllowFailure {
+			status += " (optional)"
 		}
-	} else {
-		// No signature
-		payload = map[string]interface{}{
-			"msg_type": "text",
-			"content": map[string]interface{}{
-				"text": textContent,
-			},
+		duration, exitCode := "-", "-"
+		if step.Status != "skipped" && step.Status != "pending" && step.Status != "running" {
+			duration = formatDuration(step.Duration)
+			if step.ExitCode >= 0 {
+				exitCode = fmt.Sprintf("%d", step.ExitCode)
+			} else if step.Signal != "" {
+				exitCode = step.Signal
+			}
 		}
+		rows = append(rows, stepRow(step.Name, status, duration, exitCode))
 	}
+	return rows
+}
 
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("feishu webhook returned status %d: %s", resp.StatusCode, string(body))
-	}
-
-	// Check Feishu response code
-	var feishuResp struct {
-		Code int    `json:"code"`
-		Msg  string `json:"msg"`
-	}
-	if err := json.Unmarshal(body, &feishuResp); err == nil {
-		if feishuResp.Code != 0 && feishuResp.Code != -1 {
-			return fmt.Errorf("feishu webhook returned error code %d: %s\nResponse body: %s", feishuResp.Code, feishuResp.Msg, string(body))
+// stepRow is a column set with the cells of one row of the step table
+func stepRow(name, status, duration, exitCode string) map[string]interface{} {
+	cell := func(content string, weight int) map[string]interface{} {
+		return map[string]interface{}{
+			"tag":            "column",
+			"width":          "weighted",
+			"weight":         weight,
+			"vertical_align": "top",
+			"elements": []map[string]interface{}{
+				{
+					"tag":     "markdown",
+					"content": content,
+				},
+			},
 		}
-	} else if len(body) > 0 {
-		// If we can't parse the response, include it in the error anyway
-		return fmt.Errorf("feishu webhook returned unexpected response: %s", string(body))
 	}
-
-	return nil
+	return map[string]interface{}{
+		"tag":       "column_set",
+		"flex_mode": "none",
+		"columns": []map[string]interface{}{
+			cell(name, 3),
+			cell(status, 2),
+			cell(duration, 1),
+			cell(exitCode, 1),
+		},
+	}
 }
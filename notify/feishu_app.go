@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+// tokenRefreshMargin is how long before it expires a tenant token is replaced,
+// Feishu hands out a new token once the current one has less than 30 minutes left
+const tokenRefreshMargin = 5 * time.Minute
+
+func init() {
+	Register(config.FeishuAppType, func(cfg config.NotifierConfig) (Notifier, error) {
+		return feishuAppNotifier{
+			apiURL:    strings.TrimSuffix(cfg.URL, "/"),
+			appID:     cfg.AppID,
+			appSecret: cfg.Secret,
+			chatID:    cfg.ChatID,
+		}, nil
+	})
+}
+
+// feishuAppNotifier sends cards to a group chat as a Feishu app bot, which,
+// unlike a custom bot, can update the cards it sent
+type feishuAppNotifier struct {
+	apiURL    string // open platform base URL
+	appID     string
+	appSecret string
+	chatID    string
+}
+
+// tenantToken is a cached tenant access token of an app
+type tenantToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+var (
+	tokensMu sync.Mutex
+	tokens   = make(map[string]tenantToken) // by API base URL and app id
+)
+
+func (n feishuAppNotifier) Notify(msg Message) error {
+	_, err := n.Send(msg)
+	return err
+}
+
+// Send posts the card of msg to the chat and returns its message id
+func (n feishuAppNotifier) Send(msg Message) (string, error) {
+	content, err := appCard(msg)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data struct {
+			MessageID string `json:"message_id"`
+		} `json:"data"`
+	}
+	err = n.call("POST", "/open-apis/im/v1/messages?receive_id_type=chat_id", map[string]interface{}{
+		"receive_id": n.chatID,
+		"msg_type":   "interactive",
+		"content":    content,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Data.MessageID == "" {
+		return "", fmt.Errorf("feishu api returned no message id")
+	}
+	return resp.Data.MessageID, nil
+}
+
+// Update replaces the card of a message sent earlier with the card of msg
+func (n feishuAppNotifier) Update(messageID string, msg Message) error {
+	content, err := appCard(msg)
+	if err != nil {
+		return err
+	}
+	return n.call("PATCH", "/open-apis/im/v1/messages/"+url.PathEscape(messageID), map[string]interface{}{
+		"content": content,
+	}, nil)
+}
+
+// appCard encodes the card of msg as message content, marked as updatable for everyone in the chat
+func appCard(msg Message) (string, error) {
+	card := buildCard(msg)
+	card["config"].(map[string]interface{})["update_multi"] = true
+	content, err := json.Marshal(card)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal card: %w", err)
+	}
+	return string(content), nil
+}
+
+// call sends an authenticated request to the open platform and decodes the
+// response into out, which may be nil
+func (n feishuAppNotifier) call(method, path string, payload, out interface{}) error {
+	token, err := n.tenantToken()
+	if err != nil {
+		return err
+	}
+	body, err := requestJSON(method, n.apiURL+path, payload, http.Header{"Authorization": {"Bearer " + token}})
+	if err == nil {
+		err = checkFeishuCode(body)
+	}
+	if err != nil {
+		// The token may have been revoked, fetch a new one for the next attempt
+		n.forgetToken()
+		return err
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("failed to decode feishu api response: %w", err)
+		}
+	}
+	return nil
+}
+
+// tenantToken returns the cached tenant access token of the app, fetching a new
+// one when there is none or it is about to expire
+func (n feishuAppNotifier) tenantToken() (string, error) {
+	key := n.apiURL + "|" + n.appID
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	if cached, ok := tokens[key]; ok && time.Until(cached.expiresAt) > tokenRefreshMargin {
+		return cached.token, nil
+	}
+
+	body, err := postJSON(n.apiURL+"/open-apis/auth/v3/tenant_access_token/internal", map[string]interface{}{
+		"app_id":     n.appID,
+		"app_secret": n.appSecret,
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get feishu tenant token: %w", err)
+	}
+	if err := checkFeishuCode(body); err != nil {
+		return "", fmt.Errorf("failed to get feishu tenant token: %w", err)
+	}
+	var resp struct {
+		Token  string `json:"tenant_access_token"`
+		Expire int    `json:"expire"` // seconds
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Token == "" {
+		return "", fmt.Errorf("feishu returned an unexpected tenant token response: %s", string(body))
+	}
+
+	tokens[key] = tenantToken{token: resp.Token, expiresAt: time.Now().Add(time.Duration(resp.Expire) * time.Second)}
+	return resp.Token, nil
+}
+
+// forgetToken drops the cached tenant token of the app
+func (n feishuAppNotifier) forgetToken() {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	delete(tokens, n.apiURL+"|"+n.appID)
+}
+
+// checkFeishuCode checks the code of an open platform response
+func checkFeishuCode(body []byte) error {
+	var resp struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("feishu api returned unexpected response: %s", string(body))
+	}
+	if resp.Code != 0 {
+		return fmt.Errorf("feishu api returned error code %d: %s", resp.Code, resp.Msg)
+	}
+	return nil
+}
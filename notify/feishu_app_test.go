@@ -0,0 +1,190 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+// fakeFeishu stubs the open platform endpoints used by feishu_app notifiers
+type fakeFeishu struct {
+	t      *testing.T
+	expire int // lifetime of the tenant tokens it hands out, in seconds
+
+	mu        sync.Mutex
+	tokens    int                 // tenant tokens handed out
+	sent      []map[string]string // bodies of POST /open-apis/im/v1/messages
+	patched   []string            // message ids of PATCH /open-apis/im/v1/messages/:id
+	contents  []string            // card content of every sent or patched message
+	auth      []string            // Authorization of every message request
+	failNext  bool                // answer the next message request with an error code
+	messageID int
+}
+
+func (f *fakeFeishu) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, _ := io.ReadAll(r.Body)
+	var body map[string]string
+	if err := json.Unmarshal(data, &body); err != nil {
+		f.t.Errorf("%s %s: invalid body %s", r.Method, r.URL.Path, data)
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/open-apis/auth/v3/tenant_access_token/internal":
+		if body["app_id"] != "cli_app" || body["app_secret"] != "app-secret" {
+			fmt.Fprint(w, `{"code":10014,"msg":"app secret invalid"}`)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"code":0,"msg":"ok","tenant_access_token":"t-%d","expire":%d}`, f.tokens, f.expire)
+		return
+	case strings.HasPrefix(r.URL.Path, "/open-apis/im/v1/messages"):
+		f.auth = append(f.auth, r.Header.Get("Authorization"))
+		if f.failNext {
+			f.failNext = false
+			fmt.Fprint(w, `{"code":99991663,"msg":"invalid access token"}`)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/open-apis/im/v1/messages":
+		if r.URL.Query().Get("receive_id_type") != "chat_id" {
+			f.t.Errorf("receive_id_type = %q, want chat_id", r.URL.Query().Get("receive_id_type"))
+		}
+		f.sent = append(f.sent, body)
+		f.contents = append(f.contents, body["content"])
+		f.messageID++
+		fmt.Fprintf(w, `{"code":0,"msg":"success","data":{"message_id":"om_%d"}}`, f.messageID)
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/open-apis/im/v1/messages/"):
+		f.patched = append(f.patched, strings.TrimPrefix(r.URL.Path, "/open-apis/im/v1/messages/"))
+		f.contents = append(f.contents, body["content"])
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":{}}`)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newFeishuApp starts a fake open platform and returns an app notifier using it
+func newFeishuApp(t *testing.T, fake *fakeFeishu) Updater {
+	t.Helper()
+	fake.t = t
+	server := httptest.NewServer(fake)
+	t.Cleanup(func() {
+		server.Close()
+		tokensMu.Lock()
+		delete(tokens, server.URL+"|cli_app")
+		tokensMu.Unlock()
+	})
+
+	notifier, err := New(config.NotifierConfig{Type: config.FeishuAppType, URL: server.URL + "/", AppID: "cli_app", Secret: "app-secret", ChatID: "oc_chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifier.(Updater)
+}
+
+// cardColor returns the header color of a card sent as message content, and checks it can be updated
+func cardColor(t *testing.T, content string) string {
+	t.Helper()
+	var card struct {
+		Config map[string]interface{} `json:"config"`
+		Header struct {
+			Template string `json:"template"`
+		} `json:"header"`
+	}
+	if err := json.Unmarshal([]byte(content), &card); err != nil {
+		t.Fatalf("content is not a card: %v", err)
+	}
+	if card.Config["update_multi"] != true {
+		t.Errorf("card is not updatable for everyone in the chat: config %v", card.Config)
+	}
+	return card.Header.Template
+}
+
+func TestFeishuAppSendAndUpdate(t *testing.T) {
+	fake := &fakeFeishu{expire: 7200}
+	app := newFeishuApp(t, fake)
+
+	started := testMessage
+	started.Status = StatusStarted
+	messageID, err := app.Send(started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageID != "om_1" {
+		t.Fatalf("Send returned message id %q, want om_1", messageID)
+	}
+	if err := app.Update(messageID, testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.sent) != 1 || fake.sent[0]["receive_id"] != "oc_chat" || fake.sent[0]["msg_type"] != "interactive" {
+		t.Errorf("sent %v, want one interactive message to oc_chat", fake.sent)
+	}
+	if len(fake.patched) != 1 || fake.patched[0] != "om_1" {
+		t.Errorf("patched messages %v, want the one Send returned", fake.patched)
+	}
+	if len(fake.contents) == 2 {
+		if color := cardColor(t, fake.contents[0]); color != "blue" {
+			t.Errorf("sent card is %s, want the blue started card", color)
+		}
+		if color := cardColor(t, fake.contents[1]); color != "green" {
+			t.Errorf("updated card is %s, want the green success card", color)
+		}
+	}
+
+	// The tenant token is fetched once and reused
+	if fake.tokens != 1 {
+		t.Errorf("fetched %d tenant tokens, want 1", fake.tokens)
+	}
+	for _, auth := range fake.auth {
+		if auth != "Bearer t-1" {
+			t.Errorf("Authorization = %q, want Bearer t-1", auth)
+		}
+	}
+}
+
+func TestFeishuAppTokenRefresh(t *testing.T) {
+	// Tokens with less than tokenRefreshMargin left are replaced before use
+	fake := &fakeFeishu{expire: 4 * 60}
+	app := newFeishuApp(t, fake)
+
+	for i := 0; i < 2; i++ {
+		if err := app.Notify(testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.tokens != 2 {
+		t.Errorf("fetched %d tenant tokens, want one per request", fake.tokens)
+	}
+	if len(fake.auth) == 2 && fake.auth[1] != "Bearer t-2" {
+		t.Errorf("second request Authorization = %q, want the new token", fake.auth[1])
+	}
+}
+
+func TestFeishuAppForgetsTokenOnError(t *testing.T) {
+	fake := &fakeFeishu{expire: 7200, failNext: true}
+	app := newFeishuApp(t, fake)
+
+	err := app.Update("om_1", testMessage)
+	if err == nil || !strings.Contains(err.Error(), "error code 99991663") {
+		t.Fatalf("error = %v, want the api error code", err)
+	}
+	if _, err := app.Send(testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if fake.tokens != 2 || fake.auth[1] != "Bearer t-2" {
+		t.Errorf("fetched %d tokens, retry used %q; want a new token after the error", fake.tokens, fake.auth[1])
+	}
+}
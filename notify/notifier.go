@@ -0,0 +1,320 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+// NotificationStatus represents the status of the notification
+type NotificationStatus string
+
+const (
+	StatusStarted     NotificationStatus = "started"
+	StatusSuccess     NotificationStatus = "success"
+	StatusFailure     NotificationStatus = "failure"
+	StatusTimeout     NotificationStatus = "timeout"
+	StatusPartial     NotificationStatus = "partial"
+	StatusSkipped     NotificationStatus = "skipped"
+	StatusCancelled   NotificationStatus = "cancelled"
+	StatusInterrupted NotificationStatus = "interrupted"
+)
+
+// Message is the content of a notification about a run
+type Message struct {
+	Status        NotificationStatus `json:"status"`
+	Repo          string             `json:"repo"`
+	Project       string             `json:"project"`     // shown so runs of several projects of one repo can be told apart
+	Environment   string             `json:"environment"` // empty for projects without environments
+	Author        string             `json:"author"`
+	CommitID      string             `json:"commit_id"`
+	CommitMessage string             `json:"commit_message"`
+	Branch        string             `json:"branch"` // empty for tag pushes and releases, the head branch for pull requests
+	Tag           string             `json:"tag"`    // set for tag pushes and releases
+	ReleaseName   string             `json:"release_name"`
+	ReleaseNotes  string             `json:"release_notes"`
+	PRNumber      int                `json:"pr_number"` // set for pull request checks, CommitMessage holds the title
+	BaseRef       string             `json:"base_ref"`
+	HeadRef       string             `json:"head_ref"`
+	CommitTime    time.Time          `json:"commit_time"`
+	Steps         []StepResult       `json:"steps,omitempty"`      // every step of the run, set on completion messages
+	Duration      time.Duration      `json:"duration,omitempty"`   // from the start of the first step to the end of the last
+	QueueWait     time.Duration      `json:"queue_wait,omitempty"` // how long the run waited in the queue before it started
+	Progress      bool               `json:"progress,omitempty"`   // live update of a running run, only for notifiers that are Updaters
+	Failure       *Failure           `json:"failure,omitempty"`    // the step that failed the run, set on failure and timeout messages
+}
+
+// Failure describes the first required step that failed a run
+type Failure struct {
+	Step     string `json:"step"`
+	Script   string `json:"script"`
+	Attempts int    `json:"attempts"`
+	ExitCode int    `json:"exit_code"`        // -1 when the command did not exit normally
+	Signal   string `json:"signal,omitempty"` // signal that terminated the command, if any
+	Error    string `json:"error"`
+	Stderr   string `json:"stderr"` // tail of the step's stderr, or of its output when it wrote nothing to stderr
+}
+
+// StepResult is the outcome of a step shown on completion messages
+type StepResult struct {
+	Name         string        `json:"name"`
+	Status       string        `json:"status"` // success, failed, timeout or skipped, or pending and running on progress updates
+	Duration     time.Duration `json:"duration"`
+	ExitCode     int           `json:"exit_code"`        // -1 when the command did not exit normally
+	Signal       string        `json:"signal,omitempty"` // signal that terminated the command, if any
+	AllowFailure bool          `json:"allow_failure"`
+}
+
+// Notifier delivers messages about runs to one destination
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+// Updater is a notifier that can change a message it sent earlier, so a run
+// keeps a single message that follows its progress
+type Updater interface {
+	Notifier
+	// Send delivers a new message and returns its id
+	Send(msg Message) (string, error)
+	// Update replaces the content of the message with the given id
+	Update(messageID string, msg Message) error
+}
+
+// Factory creates a notifier from its configuration
+type Factory func(cfg config.NotifierConfig) (Notifier, error)
+
+// factories holds the notifier types selectable in config, by type name
+var factories = make(map[string]Factory)
+
+// Register makes a notifier type selectable in config, backends call it from init
+func Register(kind string, factory Factory) {
+	factories[kind] = factory
+}
+
+// Types returns the registered notifier types, sorted
+func Types() []string {
+	kinds := make([]string, 0, len(factories))
+	for kind := range factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// New creates the notifier of a configured destination
+func New(cfg config.NotifierConfig) (Notifier, error) {
+	kind := cfg.Type
+	if kind == "" {
+		kind = "feishu"
+	}
+	factory, ok := factories[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown notifier type %q, must be one of %s", kind, strings.Join(Types(), ", "))
+	}
+	return factory(cfg)
+}
+
+// Validate checks that every configured notifier can be created
+func Validate(notifiers map[string]config.NotifierConfig) error {
+	for name, notifier := range notifiers {
+		if _, err := New(notifier); err != nil {
+			return fmt.Errorf("notifiers.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// statusStyle returns the emoji, card color and text of a status
+func statusStyle(status NotificationStatus) (emoji, color, text string) {
+	switch status {
+	case StatusStarted:
+		return "🚀", "blue", "Workflow Started"
+	case StatusSuccess:
+		return "✅", "green", "Success"
+	case StatusFailure:
+		return "🚨", "red", "Failure"
+	case StatusPartial:
+		return "⚠️", "yellow", "Partial Success"
+	case StatusSkipped:
+		return "⏭️", "grey", "Skipped"
+	case StatusCancelled:
+		return "🛑", "grey", "Cancelled"
+	case StatusInterrupted:
+		return "⚡", "orange", "Interrupted"
+	case StatusTimeout:
+		return "⏰", "orange", "Timeout"
+	}
+	return "ℹ️", "blue", "Notification"
+}
+
+// refOf returns the branch, tag or pull request of a message and its label
+func refOf(msg Message) (ref, label string) {
+	ref, label = msg.Branch, "Branch"
+	if msg.Tag != "" {
+		ref, label = msg.Tag, "Tag"
+	}
+	if msg.PRNumber > 0 {
+		ref, label = fmt.Sprintf("#%d", msg.PRNumber), "Pull Request"
+	}
+	return ref, label
+}
+
+// renderText renders a message as a title and markdown lines for chat backends
+// without cards; bold is the markdown of bold text, which differs between them
+func renderText(msg Message, bold func(string) string) (string, []string) {
+	emoji, _, statusText := statusStyle(msg.Status)
+	repoName := msg.Repo
+	if repoName == "" {
+		repoName = "unknown/repo"
+	}
+	author := msg.Author
+	if author == "" {
+		author = "unknown"
+	}
+	ref, refLabel := refOf(msg)
+
+	title := fmt.Sprintf("%s %s", emoji, repoName)
+	if ref != "" {
+		title += " - " + ref
+	}
+	if msg.Environment != "" {
+		title += " [" + msg.Environment + "]"
+	}
+
+	lines := []string{
+		bold("Status:") + " " + statusText,
+		bold("Author:") + " " + author,
+		bold(refLabel+":") + " " + ref,
+	}
+	if msg.Project != "" {
+		lines = append(lines, bold("Project:")+" "+msg.Project)
+	}
+	if msg.ReleaseName != "" {
+		lines = append(lines, bold("Release:")+" "+msg.ReleaseName)
+	}
+	if msg.PRNumber > 0 {
+		lines = append(lines, fmt.Sprintf("%s %s → %s", bold("Merge:"), msg.HeadRef, msg.BaseRef))
+	}
+	if msg.CommitID != "" {
+		lines = append(lines, bold("Commit ID:")+" `"+msg.CommitID+"`")
+	}
+	lines = append(lines, bold("Time:")+" "+time.Now().Format("2006-01-02 15:04:05"))
+	lines = append(lines, bold("Commit Message:"), msg.CommitMessage)
+	if msg.Failure != nil {
+		lines = append(lines, "", failureText(msg.Failure, bold))
+	}
+	return title, lines
+}
+
+// failureText renders the step that failed a run as markdown lines
+func failureText(f *Failure, bold func(string) string) string {
+	lines := []string{bold("Failed Step:") + " " + f.Step}
+	if f.Script != "" && f.Script != f.Step {
+		lines = append(lines, bold("Script:")+" "+f.Script)
+	}
+	if f.Attempts > 1 {
+		lines = append(lines, fmt.Sprintf("%s %d", bold("Attempts:"), f.Attempts))
+	}
+	if f.ExitCode >= 0 {
+		lines = append(lines, fmt.Sprintf("%s %d", bold("Exit Code:"), f.ExitCode))
+	}
+	if f.Signal != "" {
+		lines = append(lines, bold("Signal:")+" "+f.Signal)
+	}
+	if f.Error != "" {
+		lines = append(lines, bold("Error:")+" "+f.Error)
+	}
+	if f.Stderr != "" {
+		lines = append(lines, bold("Stderr:"), f.Stderr)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stepIcon returns the emoji shown for the status of a step
+func stepIcon(step StepResult) string {
+	switch step.Status {
+	case "success":
+		return "✅"
+	case "failed":
+		if step.AllowFailure {
+			return "⚠️"
+		}
+		return "❌"
+	case "timeout":
+		return "⏰"
+	case "skipped":
+		return "⏭️"
+	case "running":
+		return "🔄"
+	case "pending":
+		return "⏳"
+	}
+	return "❔"
+}
+
+// formatDuration rounds a duration for display, to the millisecond below a
+// second and to the tenth of a second above
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// postJSON posts a JSON payload and returns the response body, failing on non-2xx statuses
+func postJSON(url string, payload interface{}, header http.Header) ([]byte, error) {
+	return requestJSON("POST", url, payload, header)
+}
+
+// requestJSON sends a JSON payload with the given method and returns the
+// response body, failing on non-2xx statuses
+func requestJSON(method, url string, payload interface{}, header http.Header) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", withoutURL(err))
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// withoutURL drops the request URL from a client error, webhook URLs carry the
+// destination's token and errors are stored with failed notifications
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
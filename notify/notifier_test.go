@@ -0,0 +1,358 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+// received is a request captured by a fake destination
+type received struct {
+	method string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// newDestination starts a fake destination answering every request with
+// status and response, and returns its URL and the requests it received
+func newDestination(t *testing.T, status int, response string) (string, *[]received) {
+	t.Helper()
+	requests := &[]received{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*requests = append(*requests, received{r.Method, r.URL.Query(), r.Header.Clone(), body})
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, requests
+}
+
+// decodeBody decodes the JSON body of the only request a destination received
+func decodeBody(t *testing.T, requests []received) map[string]interface{} {
+	t.Helper()
+	if len(requests) != 1 {
+		t.Fatalf("destination received %d requests, want 1", len(requests))
+	}
+	if requests[0].method != http.MethodPost {
+		t.Errorf("method = %s, want POST", requests[0].method)
+	}
+	if contentType := requests[0].header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(requests[0].body, &payload); err != nil {
+		t.Fatalf("failed to decode payload %s: %v", requests[0].body, err)
+	}
+	return payload
+}
+
+// newTestNotifier creates a registered notifier
+func newTestNotifier(t *testing.T, cfg config.NotifierConfig) Notifier {
+	t.Helper()
+	notifier, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifier
+}
+
+var testMessage = Message{
+	Status:        StatusSuccess,
+	Repo:          "acme/app",
+	Project:       "api",
+	Environment:   "staging",
+	Author:        "octocat",
+	CommitID:      "0123abcd",
+	CommitMessage: "Fix the build",
+	Branch:        "main",
+	CommitTime:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+}
+
+func TestRegistry(t *testing.T) {
+	want := []string{"dingtalk", "feishu", "feishu_app", "slack", "webhook", "wecom"}
+	if types := Types(); !reflect.DeepEqual(types, want) {
+		t.Errorf("Types() = %v, want %v", types, want)
+	}
+
+	if _, ok := newTestNotifier(t, config.NotifierConfig{URL: "https://example.com"}).(feishuNotifier); !ok {
+		t.Errorf("a notifier without a type is not a Feishu bot")
+	}
+	if _, ok := newTestNotifier(t, config.NotifierConfig{Type: "feishu_app"}).(Updater); !ok {
+		t.Errorf("feishu_app notifier is not an Updater")
+	}
+	if _, ok := newTestNotifier(t, config.NotifierConfig{Type: "slack"}).(Updater); ok {
+		t.Errorf("slack notifier is an Updater")
+	}
+
+	_, err := New(config.NotifierConfig{Type: "teams"})
+	if err == nil || !strings.Contains(err.Error(), `unknown notifier type "teams"`) || !strings.Contains(err.Error(), strings.Join(want, ", ")) {
+		t.Errorf("New with an unknown type: error = %v, want one listing the known types", err)
+	}
+
+	err = Validate(map[string]config.NotifierConfig{
+		"ops":  {Type: "slack", URL: "https://hooks.slack.com/services/x"},
+		"chat": {Type: "teams"},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "notifiers.chat: ") {
+		t.Errorf("Validate: error = %v, want one for notifiers.chat", err)
+	}
+	if err := Validate(map[string]config.NotifierConfig{"ops": {Type: "slack"}}); err != nil {
+		t.Errorf("Validate of known types: %v", err)
+	}
+
+	// Types registered later are selectable like the built-in ones
+	var got config.NotifierConfig
+	Register("test", func(cfg config.NotifierConfig) (Notifier, error) {
+		got = cfg
+		return slackNotifier{webhookURL: cfg.URL}, nil
+	})
+	t.Cleanup(func() { delete(factories, "test") })
+	cfg := config.NotifierConfig{Type: "test", URL: "https://example.com/hook"}
+	if _, err := New(cfg); err != nil || got != cfg {
+		t.Errorf("New of a registered type: err %v, factory got %+v", err, got)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	destination, requests := newDestination(t, http.StatusOK, "ok")
+	if err := newTestNotifier(t, config.NotifierConfig{Type: "slack", URL: destination}).Notify(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := decodeBody(t, *requests)
+	text, _ := payload["text"].(string)
+	for _, want := range []string{"*✅ acme/app - main [staging]*\n", "*Status:* Success", "*Project:* api", "*Commit ID:* `0123abcd`", "Fix the build"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestDingTalkNotifier(t *testing.T) {
+	destination, requests := newDestination(t, http.StatusOK, `{"errcode":0,"errmsg":"ok"}`)
+	notifier := newTestNotifier(t, config.NotifierConfig{Type: "dingtalk", URL: destination + "/robot/send?access_token=abc", Secret: "SECsecret"})
+	before := time.Now().UnixMilli()
+	if err := notifier.Notify(testMessage); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixMilli()
+
+	payload := decodeBody(t, *requests)
+	if payload["msgtype"] != "markdown" {
+		t.Errorf("msgtype = %v, want markdown", payload["msgtype"])
+	}
+	markdown, _ := payload["markdown"].(map[string]interface{})
+	if markdown["title"] != "✅ acme/app - main [staging]" {
+		t.Errorf("title = %v", markdown["title"])
+	}
+	if text, _ := markdown["text"].(string); !strings.HasPrefix(text, "### ✅ acme/app - main [staging]\n\n**Status:** Success\n\n") {
+		t.Errorf("text = %q", text)
+	}
+
+	query := (*requests)[0].query
+	if query.Get("access_token") != "abc" {
+		t.Errorf("access_token = %q, want the one of the robot URL", query.Get("access_token"))
+	}
+	timestamp, err := strconv.ParseInt(query.Get("timestamp"), 10, 64)
+	if err != nil || timestamp < before || timestamp > after {
+		t.Fatalf("timestamp = %q, want the current time in milliseconds", query.Get("timestamp"))
+	}
+	mac := hmac.New(sha256.New, []byte("SECsecret"))
+	mac.Write([]byte(query.Get("timestamp") + "\nSECsecret"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); query.Get("sign") != want {
+		t.Errorf("sign = %q, want %q", query.Get("sign"), want)
+	}
+}
+
+func TestSignDingTalkURL(t *testing.T) {
+	// The signature is base64 with + and /, which must be escaped in the query
+	signed, err := signDingTalkURL("https://oapi.dingtalk.com/robot/send?access_token=abc", "SEC000", time.UnixMilli(1700000000000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("SEC000"))
+	mac.Write([]byte("1700000000000\nSEC000"))
+	want := "https://oapi.dingtalk.com/robot/send?" + url.Values{
+		"access_token": {"abc"},
+		"timestamp":    {"1700000000000"},
+		"sign":         {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}.Encode()
+	if signed != want {
+		t.Errorf("signed URL = %s, want %s", signed, want)
+	}
+}
+
+func TestWeComNotifier(t *testing.T) {
+	destination, requests := newDestination(t, http.StatusOK, `{"errcode":0,"errmsg":"ok"}`)
+	if err := newTestNotifier(t, config.NotifierConfig{Type: "wecom", URL: destination}).Notify(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := decodeBody(t, *requests)
+	if payload["msgtype"] != "markdown" {
+		t.Errorf("msgtype = %v, want markdown", payload["msgtype"])
+	}
+	markdown, _ := payload["markdown"].(map[string]interface{})
+	if content, _ := markdown["content"].(string); !strings.HasPrefix(content, "### ✅ acme/app - main [staging]\n**Status:** Success\n") {
+		t.Errorf("content = %q", content)
+	}
+}
+
+func TestRobotErrorCodes(t *testing.T) {
+	for _, kind := range []string{"dingtalk", "wecom"} {
+		destination, _ := newDestination(t, http.StatusOK, `{"errcode":93000,"errmsg":"invalid webhook url"}`)
+		err := newTestNotifier(t, config.NotifierConfig{Type: kind, URL: destination}).Notify(testMessage)
+		if err == nil || !strings.Contains(err.Error(), "error code 93000: invalid webhook url") {
+			t.Errorf("%s: error = %v, want the robot's error code", kind, err)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	for _, secret := range []string{"", "hmac-key"} {
+		destination, requests := newDestination(t, http.StatusNoContent, "")
+		if err := newTestNotifier(t, config.NotifierConfig{Type: "webhook", URL: destination, Secret: secret}).Notify(testMessage); err != nil {
+			t.Fatal(err)
+		}
+		if len(*requests) != 1 {
+			t.Fatalf("destination received %d requests, want 1", len(*requests))
+		}
+		request := (*requests)[0]
+
+		var msg Message
+		if err := json.Unmarshal(request.body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, testMessage) {
+			t.Errorf("payload = %+v, want the message", msg)
+		}
+
+		signature := request.header.Get(SignatureHeader)
+		if secret == "" {
+			if signature != "" {
+				t.Errorf("unsigned webhook has %s %q", SignatureHeader, signature)
+			}
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(request.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+			t.Errorf("%s = %q, want %q", SignatureHeader, signature, want)
+		}
+	}
+}
+
+func TestFeishuNotifier(t *testing.T) {
+	destination, requests := newDestination(t, http.StatusOK, `{"code":0,"msg":"success"}`)
+	if err := newTestNotifier(t, config.NotifierConfig{URL: destination, Secret: "bot-secret"}).Notify(testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := decodeBody(t, *requests)
+	if payload["msg_type"] != "interactive" {
+		t.Errorf("msg_type = %v, want interactive", payload["msg_type"])
+	}
+	if _, ok := payload["card"].(map[string]interface{}); !ok {
+		t.Errorf("payload has no card")
+	}
+	// The environment is shown once, in the title
+	card, _ := json.Marshal(payload["card"])
+	if strings.Count(string(card), "staging") != 1 || !strings.Contains(string(card), "main [staging]") {
+		t.Errorf("card %s does not show the environment once, in its title", card)
+	}
+	timestamp, _ := payload["timestamp"].(float64)
+	if now := time.Now().Unix(); int64(timestamp) > now || int64(timestamp) < now-5 {
+		t.Fatalf("timestamp = %v, want the current time in seconds", payload["timestamp"])
+	}
+	// Feishu signs an empty message with timestamp + "\n" + secret as the key
+	mac := hmac.New(sha256.New, []byte(strconv.FormatInt(int64(timestamp), 10)+"\nbot-secret"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); payload["sign"] != want {
+		t.Errorf("sign = %v, want %s", payload["sign"], want)
+	}
+
+	destination, _ = newDestination(t, http.StatusOK, `{"code":19021,"msg":"sign match fail"}`)
+	err := newTestNotifier(t, config.NotifierConfig{URL: destination}).Notify(testMessage)
+	if err == nil || !strings.Contains(err.Error(), "error code 19021") {
+		t.Errorf("error = %v, want the bot's error code", err)
+	}
+}
+
+func TestNotifierErrorsLeaveOutTheURL(t *testing.T) {
+	destination, _ := newDestination(t, http.StatusBadGateway, "bad gateway")
+	err := newTestNotifier(t, config.NotifierConfig{Type: "slack", URL: destination + "/services/T0/B0/token-in-url"}).Notify(testMessage)
+	if err == nil || !strings.Contains(err.Error(), "status 502") {
+		t.Errorf("error = %v, want the response status", err)
+	}
+
+	// Connection errors of net/http include the URL, which carries the destination's token
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	for _, kind := range []string{"feishu", "slack", "dingtalk", "wecom", "webhook"} {
+		err := newTestNotifier(t, config.NotifierConfig{Type: kind, URL: server.URL + "/hook?access_token=token-in-url"}).Notify(testMessage)
+		if err == nil || strings.Contains(err.Error(), "token-in-url") {
+			t.Errorf("%s: error = %v, want one without the URL", kind, err)
+		}
+	}
+}
+
+func TestFailureIsRenderedApartFromTheCommitMessage(t *testing.T) {
+	msg := testMessage
+	msg.Status = StatusFailure
+	msg.Failure = &Failure{Step: "test", Script: "make test", Attempts: 2, ExitCode: 2, Error: "exit status 2", Stderr: "FAIL: TestLogin"}
+
+	_, lines := renderText(msg, func(s string) string { return "*" + s + "*" })
+	text := strings.Join(lines, "\n")
+	if !strings.Contains(text, "*Commit Message:*\nFix the build\n\n*Failed Step:* test\n") {
+		t.Errorf("text %q does not have the failure after the commit message", text)
+	}
+	for _, want := range []string{"*Script:* make test", "*Attempts:* 2", "*Exit Code:* 2", "*Error:* exit status 2", "*Stderr:*\nFAIL: TestLogin"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text %q does not contain %q", text, want)
+		}
+	}
+
+	data, err := json.Marshal(buildCard(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var card struct {
+		Elements []struct {
+			Text struct {
+				Content string `json:"content"`
+			} `json:"text"`
+		} `json:"elements"`
+	}
+	if err := json.Unmarshal(data, &card); err != nil {
+		t.Fatal(err)
+	}
+	commit, failure := "", ""
+	for _, element := range card.Elements {
+		if strings.HasPrefix(element.Text.Content, "**Commit Message:**") {
+			commit = element.Text.Content
+		}
+		if strings.HasPrefix(element.Text.Content, "**Failed Step:**") {
+			failure = element.Text.Content
+		}
+	}
+	if commit != "**Commit Message:**\nFix the build" {
+		t.Errorf("commit message element = %q, want only the commit message", commit)
+	}
+	if !strings.Contains(failure, "**Stderr:**\nFAIL: TestLogin") {
+		t.Errorf("failure element = %q, want the stderr tail", failure)
+	}
+}
@@ -0,0 +1,27 @@
+package notify
+
+import (
+	"strings"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+func init() {
+	Register("slack", func(cfg config.NotifierConfig) (Notifier, error) {
+		return slackNotifier{webhookURL: cfg.URL}, nil
+	})
+}
+
+// slackNotifier posts messages to a Slack incoming webhook
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (n slackNotifier) Notify(msg Message) error {
+	title, lines := renderText(msg, func(s string) string { return "*" + s + "*" })
+	// Incoming webhooks answer with a plain "ok", errors come with a non-2xx status
+	_, err := postJSON(n.webhookURL, map[string]interface{}{
+		"text": "*" + title + "*\n" + strings.Join(lines, "\n"),
+	}, nil)
+	return err
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of generic webhook bodies, like GitHub's X-Hub-Signature-256
+const SignatureHeader = "X-Sentry-Signature-256"
+
+func init() {
+	Register("webhook", func(cfg config.NotifierConfig) (Notifier, error) {
+		return webhookNotifier{url: cfg.URL, secret: cfg.Secret}, nil
+	})
+}
+
+// webhookNotifier posts the message as JSON to any URL
+type webhookNotifier struct {
+	url    string
+	secret string // signs the body when set
+}
+
+func (n webhookNotifier) Notify(msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	header := http.Header{}
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	// A raw message is sent as is, so the signature matches the body
+	_, err = postJSON(n.url, json.RawMessage(body), header)
+	return err
+}
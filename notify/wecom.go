@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"strings"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+func init() {
+	Register("wecom", func(cfg config.NotifierConfig) (Notifier, error) {
+		return weComNotifier{webhookURL: cfg.URL}, nil
+	})
+}
+
+// weComNotifier sends markdown messages to a WeCom (WeChat Work) group bot
+type weComNotifier struct {
+	webhookURL string
+}
+
+func (n weComNotifier) Notify(msg Message) error {
+	title, lines := renderText(msg, func(s string) string { return "**" + s + "**" })
+	body, err := postJSON(n.webhookURL, map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]interface{}{
+			"content": "### " + title + "\n" + strings.Join(lines, "\n"),
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return checkErrCode("wecom", body)
+}
@@ -0,0 +1,231 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/database"
+	"github.com/allintech/github-sentry/logger"
+	"github.com/allintech/github-sentry/notify"
+)
+
+// claimLease is how long a claimed notification is hidden from other senders,
+// longer than a notifier's request timeout
+const claimLease = time.Minute
+
+// Sender delivers the notifications stored in the outbox table
+// Notifications are stored when a run changes state and sent by a loop polling
+// the table, so they survive restarts and are retried when a destination fails
+type Sender struct {
+	ctx  context.Context
+	cfg  *config.Config
+	wake chan struct{}
+
+	stopOnce sync.Once
+	stopping chan struct{}
+	loopDone chan struct{}
+}
+
+// NewSender creates a sender that routes and delivers notifications with cfg,
+// its loop stops when ctx is done or Shutdown is called
+func NewSender(ctx context.Context, cfg *config.Config) *Sender {
+	return &Sender{
+		ctx:      ctx,
+		cfg:      cfg,
+		wake:     make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+		loopDone: make(chan struct{}),
+	}
+}
+
+// Enqueue stores a notification about a run for every destination routed for
+// its project, environment and status; the sender delivers them in the background
+func (s *Sender) Enqueue(triggerID int64, msg notify.Message) error {
+	names := s.cfg.NotifyTargetNames(msg.Project, msg.Environment, string(msg.Status))
+	if len(names) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	for _, name := range names {
+		target, ok := s.cfg.NotifyTarget(msg.Project, msg.Environment, name)
+		if !ok || (msg.Progress && !updatesInPlace(target)) {
+			continue
+		}
+		_, err := database.EnqueueNotification(database.Notification{
+			TriggerID:   triggerID,
+			Project:     msg.Project,
+			Environment: msg.Environment,
+			Target:      name,
+			Message:     data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Wake()
+	return nil
+}
+
+// UpdatesInPlace reports whether a notification about a run of the project and
+// environment with the given status goes to a destination that updates its
+// messages, so progress updates of the run are worth queueing
+func (s *Sender) UpdatesInPlace(project, environment string, status notify.NotificationStatus) bool {
+	for _, target := range s.cfg.NotifyTargets(project, environment, string(status)) {
+		if updatesInPlace(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// updatesInPlace reports whether the notifier of a destination is an Updater
+func updatesInPlace(target config.NotifierConfig) bool {
+	notifier, err := notify.New(target)
+	if err != nil {
+		return false
+	}
+	_, ok := notifier.(notify.Updater)
+	return ok
+}
+
+// Start launches the sender loop
+// Notifications left pending by a previous process are delivered as they come due
+func (s *Sender) Start() {
+	go s.loop()
+}
+
+// Shutdown stops the sender after a last pass over due notifications, so the
+// results of jobs drained on shutdown still go out; it gives up when ctx expires
+// and whatever is left pending is delivered after the next start
+// Calling it again waits for the same loop
+func (s *Sender) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopping) })
+	select {
+	case <-s.loopDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wake makes the sender look for due notifications without waiting for the next poll
+func (s *Sender) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Sender) loop() {
+	defer close(s.loopDone)
+
+	for {
+		s.sendDue()
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.stopping:
+			s.sendDue()
+			return
+		case <-s.wake:
+		case <-time.After(s.cfg.Notifications.PollInterval):
+		}
+	}
+}
+
+// sendDue delivers notifications until none is due
+func (s *Sender) sendDue() {
+	for s.ctx.Err() == nil {
+		n, err := database.ClaimNotification(claimLease)
+		if err != nil {
+			logger.LogError("failed to claim notification: %v", err)
+			return
+		}
+		if n == nil {
+			return
+		}
+		s.send(n)
+	}
+}
+
+// send makes one delivery attempt and records its outcome
+func (s *Sender) send(n *database.Notification) {
+	var msg notify.Message
+	err := json.Unmarshal(n.Message, &msg)
+	externalID := ""
+	if err != nil {
+		err = fmt.Errorf("failed to decode notification: %w", err)
+	} else {
+		externalID, err = s.deliver(n, msg)
+	}
+	if err == nil {
+		if err := database.MarkNotificationSent(n.ID, externalID); err != nil {
+			logger.LogError("%v", err)
+		}
+		return
+	}
+
+	attempts := n.Attempts + 1
+	dead := giveUp(s.cfg.Notifications, attempts, msg.Progress)
+	retryIn := backoff(s.cfg.Notifications, attempts)
+	if dead {
+		logger.LogError("giving up on notification %d of run %d to %s after %d attempts: %v", n.ID, n.TriggerID, n.Target, attempts, err)
+	} else {
+		logger.LogError("failed to send notification %d of run %d to %s (attempt %d, retrying in %s): %v", n.ID, n.TriggerID, n.Target, attempts, retryIn, err)
+	}
+	if err := database.MarkNotificationFailed(n.ID, err.Error(), retryIn, dead); err != nil {
+		logger.LogError("%v", err)
+	}
+}
+
+// deliver sends a notification to its destination, resolved from the current config
+// Destinations that update messages in place get one message per run, which
+// later notifications of the run replace; its id is returned
+func (s *Sender) deliver(n *database.Notification, msg notify.Message) (string, error) {
+	target, ok := s.cfg.NotifyTarget(n.Project, n.Environment, n.Target)
+	if !ok {
+		return "", fmt.Errorf("notifier %s is not configured", n.Target)
+	}
+	notifier, err := notify.New(target)
+	if err != nil {
+		return "", err
+	}
+	updater, ok := notifier.(notify.Updater)
+	if !ok || n.TriggerID == 0 {
+		return "", notifier.Notify(msg)
+	}
+
+	messageID, err := database.NotificationExternalID(n.TriggerID, n.Target)
+	if err != nil {
+		return "", err
+	}
+	if messageID == "" {
+		return updater.Send(msg)
+	}
+	return messageID, updater.Update(messageID, msg)
+}
+
+// giveUp reports whether a notification is marked dead after the given number of failed attempts
+// Progress updates go dead after their first failure, a later update or the result replaces them
+func giveUp(c config.NotificationsConfig, attempts int, progress bool) bool {
+	return progress || attempts >= c.MaxAttempts
+}
+
+// backoff returns the delay before the next attempt after the given number of failed attempts
+func backoff(c config.NotificationsConfig, attempts int) time.Duration {
+	delay := c.Backoff
+	for i := 1; i < attempts && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, c.MaxBackoff)
+}
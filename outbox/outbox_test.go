@@ -0,0 +1,59 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+)
+
+var notificationsConfig = config.NotificationsConfig{
+	MaxAttempts: 8,
+	Backoff:     10 * time.Second,
+	MaxBackoff:  30 * time.Minute,
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{8, 1280 * time.Second},
+		{9, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoff(notificationsConfig, tt.attempts); got != tt.want {
+			t.Errorf("backoff after %d attempts = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+
+	// max_backoff below backoff caps the first retry too
+	capped := config.NotificationsConfig{Backoff: time.Minute, MaxBackoff: 30 * time.Second}
+	if got := backoff(capped, 1); got != 30*time.Second {
+		t.Errorf("backoff above max_backoff = %s, want 30s", got)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	tests := []struct {
+		attempts int
+		progress bool
+		want     bool
+	}{
+		{1, false, false},
+		{7, false, false},
+		{8, false, true},
+		{9, false, true},
+		// Progress updates are not retried
+		{1, true, true},
+	}
+	for _, tt := range tests {
+		if got := giveUp(notificationsConfig, tt.attempts, tt.progress); got != tt.want {
+			t.Errorf("giveUp after %d attempts (progress %t) = %t, want %t", tt.attempts, tt.progress, got, tt.want)
+		}
+	}
+}
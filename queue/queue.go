@@ -0,0 +1,303 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/allintech/github-sentry/database"
+	"github.com/allintech/github-sentry/logger"
+)
+
+// Policy decides what happens to runs of a concurrency group when a new run is submitted
+type Policy string
+
+const (
+	// PolicyQueue runs every submitted job, one after another
+	PolicyQueue Policy = "queue"
+	// PolicyCancelInProgress cancels the running job and drops pending ones in favour of the new job
+	PolicyCancelInProgress Policy = "cancel-in-progress"
+	// PolicySkipPending lets the running job finish but only keeps the newest pending job
+	PolicySkipPending Policy = "skip-pending"
+)
+
+// ErrShutdown is the cancellation cause of jobs still running when the drain timeout of Shutdown expires
+var ErrShutdown = errors.New("server shutting down")
+
+// interruptGrace bounds how long Shutdown waits for jobs to record their
+// interruption once they have been cancelled
+const interruptGrace = 30 * time.Second
+
+// Handler runs and reports jobs claimed from the jobs table
+type Handler struct {
+	// Run executes a job, ctx is cancelled with a cause when the job is superseded
+	Run func(ctx context.Context, job *database.Job)
+	// Skip is called instead of Run when a job is dropped before it started
+	Skip func(job *database.Job, reason string)
+	// Interrupted is called for jobs found running at startup, which the
+	// previous process did not finish; requeued tells whether they run again
+	// Jobs interrupted by Shutdown are reported by Run itself, their context is
+	// cancelled with ErrShutdown
+	Interrupted func(job *database.Job, requeued bool)
+}
+
+// Manager runs jobs from the jobs table, one at a time per concurrency group
+// Jobs survive restarts: they are stored before the webhook is acknowledged and
+// claimed by a worker loop polling the table
+type Manager struct {
+	ctx          context.Context
+	handler      Handler
+	worker       string
+	pollInterval time.Duration
+	requeue      bool
+
+	mu      sync.Mutex
+	running map[int64]context.CancelCauseFunc // by job id
+	active  sync.WaitGroup
+	wake    chan struct{}
+
+	stopping chan struct{}
+	loopDone chan struct{}
+}
+
+// NewManager creates a manager whose jobs run with contexts derived from ctx
+// The worker name identifies this instance in the jobs table and must stay the
+// same across restarts, so Recover finds the jobs it left running
+// When requeueInterrupted is set, jobs interrupted by a restart or shutdown are queued again
+func NewManager(ctx context.Context, handler Handler, worker string, pollInterval time.Duration, requeueInterrupted bool) *Manager {
+	return &Manager{
+		ctx:          ctx,
+		handler:      handler,
+		worker:       worker,
+		pollInterval: pollInterval,
+		requeue:      requeueInterrupted,
+		running:      make(map[int64]context.CancelCauseFunc),
+		wake:         make(chan struct{}, 1),
+		stopping:     make(chan struct{}),
+		loopDone:     make(chan struct{}),
+	}
+}
+
+// effects tells what submitting a job under the policy does to the jobs already
+// in its group: whether queued jobs are dropped and running jobs cancelled
+func (p Policy) effects() (supersedeQueued, cancelRunning bool) {
+	switch p {
+	case PolicyCancelInProgress:
+		return true, true
+	case PolicySkipPending:
+		return true, false
+	}
+	return false, false
+}
+
+// Enqueue stores a job for a trigger, applying the policy to the jobs already in its group
+func (m *Manager) Enqueue(triggerID int64, group string, policy Policy, payload []byte) (int64, error) {
+	reason := fmt.Sprintf("superseded by run %d", triggerID)
+	supersede, cancelRunning := policy.effects()
+
+	jobID, superseded, err := database.EnqueueJob(triggerID, group, string(policy), payload, supersede, reason)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, job := range superseded {
+		if m.handler.Skip != nil {
+			go m.handler.Skip(job, reason)
+		}
+	}
+
+	// Running jobs of other instances are cancelled by their own worker loop,
+	// which sees the request on its next poll
+	if cancelRunning {
+		running, err := database.RequestCancel(group, reason)
+		if err != nil {
+			logger.LogError("failed to cancel running jobs of group %s: %v", group, err)
+		}
+		for _, job := range running {
+			m.cancel(job.ID, fmt.Errorf("cancelled: %s", reason))
+		}
+	}
+
+	m.Wake()
+	return jobID, nil
+}
+
+// Recover marks jobs this worker left running before a restart as interrupted and,
+// if the manager requeues interrupted jobs, queues them again; it must run before Start
+// Jobs running on other instances are not touched
+func (m *Manager) Recover() error {
+	jobs, err := database.InterruptRunningJobs(m.worker, "interrupted by restart")
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		requeued := m.requeueJob(job)
+		logger.LogInfo("job %d of run %d was interrupted by a restart (requeued: %t)", job.ID, job.TriggerID, requeued)
+		if m.handler.Interrupted != nil {
+			m.handler.Interrupted(job, requeued)
+		}
+	}
+
+	return nil
+}
+
+// Start launches the worker loop, which stops when the manager's context is done or Shutdown is called
+func (m *Manager) Start() {
+	go m.loop()
+}
+
+// Shutdown stops claiming jobs and waits for running jobs to finish
+// If ctx expires first, the remaining jobs are cancelled with ErrShutdown, which
+// terminates their commands, and Shutdown waits a little longer for them to
+// record the interruption before returning ctx's error
+func (m *Manager) Shutdown(ctx context.Context) error {
+	close(m.stopping)
+	<-m.loopDone
+
+	drained := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	logger.LogInfo("drain timeout expired, interrupting %d running job(s)", len(m.running))
+	for _, cancel := range m.running {
+		cancel(ErrShutdown)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-drained:
+	case <-time.After(interruptGrace):
+		logger.LogError("jobs did not stop within %s of being interrupted", interruptGrace)
+	}
+	return ctx.Err()
+}
+
+// Wake makes the worker loop look for runnable jobs without waiting for the next poll
+func (m *Manager) Wake() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) loop() {
+	defer close(m.loopDone)
+
+	for {
+		m.applyCancelRequests()
+
+		for m.ctx.Err() == nil && !m.isStopping() {
+			job, err := database.ClaimJob(m.worker)
+			if err != nil {
+				logger.LogError("failed to claim job: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			m.start(job)
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.stopping:
+			return
+		case <-m.wake:
+		case <-time.After(m.pollInterval):
+		}
+	}
+}
+
+// start runs a claimed job in the background and records how it ended
+func (m *Manager) start(job *database.Job) {
+	ctx, cancel := context.WithCancelCause(m.ctx)
+
+	m.mu.Lock()
+	m.running[job.ID] = cancel
+	m.mu.Unlock()
+	m.active.Add(1)
+
+	go func() {
+		defer m.active.Done()
+		defer func() {
+			m.mu.Lock()
+			delete(m.running, job.ID)
+			m.mu.Unlock()
+			cancel(nil)
+			// The group is free again, its next job can be claimed
+			m.Wake()
+		}()
+
+		m.handler.Run(ctx, job)
+
+		status, errorMsg := database.JobDone, ""
+		cause := context.Cause(ctx)
+		if errors.Is(cause, ErrShutdown) {
+			status, errorMsg = database.JobInterrupted, cause.Error()
+		} else if cause != nil {
+			status, errorMsg = database.JobCancelled, cause.Error()
+		}
+		if err := database.FinishJob(job.ID, status, errorMsg); err != nil {
+			logger.LogError("failed to finish job %d: %v", job.ID, err)
+		}
+		if status == database.JobInterrupted {
+			m.requeueJob(job)
+		}
+	}()
+}
+
+// requeueJob queues an interrupted job again if the manager is configured to
+func (m *Manager) requeueJob(job *database.Job) bool {
+	if !m.requeue {
+		return false
+	}
+	if _, err := database.RequeueJob(job); err != nil {
+		logger.LogError("failed to requeue interrupted job %d: %v", job.ID, err)
+		return false
+	}
+	return true
+}
+
+func (m *Manager) isStopping() bool {
+	select {
+	case <-m.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// applyCancelRequests cancels the jobs of this worker that another instance asked to cancel
+func (m *Manager) applyCancelRequests() {
+	jobs, err := database.CancelRequestedJobs(m.worker)
+	if err != nil {
+		logger.LogError("failed to look up cancelled jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		m.cancel(job.ID, fmt.Errorf("cancelled: %s", job.CancelReason))
+	}
+}
+
+// cancel stops a job running in this process
+func (m *Manager) cancel(jobID int64, cause error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cancel, ok := m.running[jobID]; ok {
+		cancel(cause)
+	}
+}
@@ -0,0 +1,24 @@
+package queue
+
+import "testing"
+
+func TestPolicyEffects(t *testing.T) {
+	tests := []struct {
+		policy              Policy
+		wantSupersedeQueued bool
+		wantCancelRunning   bool
+	}{
+		{PolicyQueue, false, false},
+		{PolicyCancelInProgress, true, true},
+		{PolicySkipPending, true, false},
+		// Jobs queued with a policy that is no longer known just queue up
+		{Policy(""), false, false},
+		{Policy("cancel-pending"), false, false},
+	}
+	for _, tt := range tests {
+		supersedeQueued, cancelRunning := tt.policy.effects()
+		if supersedeQueued != tt.wantSupersedeQueued || cancelRunning != tt.wantCancelRunning {
+			t.Errorf("%q: effects() = (%t, %t), want (%t, %t)", tt.policy, supersedeQueued, cancelRunning, tt.wantSupersedeQueued, tt.wantCancelRunning)
+		}
+	}
+}
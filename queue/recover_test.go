@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/allintech/github-sentry/config"
+	"github.com/allintech/github-sentry/database"
+)
+
+// openTestDB connects to the database in DATABASE_URL and empties it; tests
+// that need Postgres are skipped when it is not set
+// DATABASE_URL must point at a scratch database, its rows are deleted
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	if port == 0 {
+		port = 5432
+	}
+	password, _ := u.User.Password()
+	cfg := &config.Config{Database: config.DatabaseConfig{
+		Host:     u.Hostname(),
+		Port:     port,
+		User:     u.User.Username(),
+		Password: password,
+		DBName:   u.Path[1:],
+		SSLMode:  u.Query().Get("sslmode"),
+	}}
+	if cfg.Database.SSLMode == "" {
+		cfg.Database.SSLMode = "disable"
+	}
+
+	if err := database.InitDB(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if _, err := database.GetDB().Exec(`TRUNCATE triggers, executions, execution_logs, jobs, job_groups, deliveries, notifications RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// claimTestJob queues a job for a new trigger and claims it as worker
+func claimTestJob(t *testing.T, group, worker string) *database.Job {
+	t.Helper()
+	triggerID, err := database.RecordTrigger(database.Trigger{Time: time.Now(), CommitID: "0123abcd", CommitMessage: "test", Branch: "main", RefType: "branch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := database.EnqueueJob(triggerID, group, string(PolicyQueue), []byte(`{}`), false, ""); err != nil {
+		t.Fatal(err)
+	}
+	job, err := database.ClaimJob(worker)
+	if err != nil || job == nil {
+		t.Fatalf("ClaimJob = %v, %v", job, err)
+	}
+	return job
+}
+
+func TestRecover(t *testing.T) {
+	for _, requeue := range []bool{false, true} {
+		t.Run("requeue="+strconv.FormatBool(requeue), func(t *testing.T) {
+			testRecover(t, requeue)
+		})
+	}
+}
+
+func testRecover(t *testing.T, requeue bool) {
+	openTestDB(t)
+	mine := claimTestJob(t, "app", "worker-a")
+	claimTestJob(t, "other", "worker-b")
+
+	interrupted := make(map[int64]bool)
+	m := NewManager(context.Background(), Handler{
+		Interrupted: func(job *database.Job, requeued bool) { interrupted[job.ID] = requeued },
+	}, "worker-a", time.Second, requeue)
+	if err := m.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(interrupted) != 1 {
+		t.Fatalf("%d jobs reported interrupted, want only job %d of this worker", len(interrupted), mine.ID)
+	}
+	if requeued, ok := interrupted[mine.ID]; !ok || requeued != requeue {
+		t.Errorf("job %d reported requeued %t", mine.ID, requeued)
+	}
+
+	// Only the requeued job can be claimed, the other worker's job still runs
+	job, err := database.ClaimJob("worker-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requeue {
+		if job != nil {
+			t.Errorf("claimed job %d although nothing was requeued", job.ID)
+		}
+		return
+	}
+	if job == nil || job.TriggerID != mine.TriggerID || job.ID == mine.ID {
+		t.Fatalf("claimed %v, want a new job for trigger %d", job, mine.TriggerID)
+	}
+}
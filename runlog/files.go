@@ -0,0 +1,33 @@
+package runlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChangedFilesPath returns the file listing the changed files of a run inside the log folder
+func ChangedFilesPath(logFolder string, triggerID int64) string {
+	return filepath.Join(logFolder, "runs", fmt.Sprintf("run-%d.changed-files", triggerID))
+}
+
+// WriteChangedFiles writes the changed files of a run, one per line, and returns the file's absolute path
+func WriteChangedFiles(logFolder string, triggerID int64, files []string) (string, error) {
+	path, err := filepath.Abs(ChangedFilesPath(logFolder, triggerID))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve changed files path: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create run log folder: %w", err)
+	}
+
+	content := strings.Join(files, "\n")
+	if len(files) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("failed to write changed files: %w", err)
+	}
+	return path, nil
+}
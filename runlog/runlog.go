@@ -0,0 +1,150 @@
+package runlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allintech/github-sentry/database"
+	"github.com/allintech/github-sentry/executor"
+	"github.com/allintech/github-sentry/logger"
+)
+
+const (
+	// flushInterval is how often buffered lines are written to the database
+	flushInterval = time.Second
+	// maxChunkLines flushes a chunk early once this many lines are buffered
+	maxChunkLines = 200
+)
+
+// Writer streams the output of a run to a log file and, in chunks, to the execution_logs table
+type Writer struct {
+	triggerID int64
+	file      *os.File
+
+	mu      sync.Mutex
+	pending []string
+	first   time.Time
+	last    time.Time
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Path returns the log file of a run inside the log folder
+func Path(logFolder string, triggerID int64) string {
+	return filepath.Join(logFolder, "runs", fmt.Sprintf("run-%d.log", triggerID))
+}
+
+// Open creates the log file of a run and starts flushing lines to the database
+func Open(logFolder string, triggerID int64) (*Writer, error) {
+	path := Path(logFolder, triggerID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create run log folder: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run log file: %w", err)
+	}
+
+	w := &Writer{
+		triggerID: triggerID,
+		file:      file,
+		kick:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go w.flushLoop()
+
+	return w, nil
+}
+
+// WriteLine appends a line of step output, it is safe for concurrent use
+func (w *Writer) WriteLine(line executor.Line) {
+	formatted := FormatLine(line)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.WriteString(formatted + "\n"); err != nil {
+		logger.LogError("failed to write run log for trigger %d: %v", w.triggerID, err)
+	}
+
+	if len(w.pending) == 0 {
+		w.first = line.Time
+	}
+	w.last = line.Time
+	w.pending = append(w.pending, formatted)
+
+	if len(w.pending) >= maxChunkLines {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close flushes the remaining lines and closes the log file
+func (w *Writer) Close() error {
+	close(w.stop)
+	<-w.done
+	return w.file.Close()
+}
+
+// FormatLine renders a line as it appears in the log file and the database
+func FormatLine(line executor.Line) string {
+	step := line.Step
+	if line.Attempt > 1 {
+		step = fmt.Sprintf("%s#%d", step, line.Attempt)
+	}
+	return fmt.Sprintf("%s [%s] %s | %s", line.Time.Format("2006-01-02T15:04:05.000000Z07:00"), step, line.Stream, line.Text)
+}
+
+// flushLoop writes buffered lines to the database until the writer is closed
+// Chunks are only inserted from this goroutine, so their ids keep line order
+func (w *Writer) flushLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.kick:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			return
+		}
+	}
+}
+
+func (w *Writer) flush() {
+	w.mu.Lock()
+	lines := w.pending
+	first, last := w.first, w.last
+	w.pending = nil
+	w.mu.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	chunk := database.LogChunk{
+		TriggerID:   w.triggerID,
+		Content:     strings.Join(lines, "\n") + "\n",
+		LineCount:   len(lines),
+		FirstLineAt: first,
+		LastLineAt:  last,
+	}
+	if err := database.AppendLogChunk(chunk); err != nil {
+		logger.LogError("failed to store run log for trigger %d: %v", w.triggerID, err)
+	}
+}
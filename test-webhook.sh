@@ -9,10 +9,13 @@
 #   WEBHOOK_SECRET=your_actual_secret make test
 #   # Or with custom URL:
 #   WEBHOOK_URL=https://your-server.com/webhook WEBHOOK_SECRET=secret make test
+#   # Resend a delivery (ignored as a duplicate, replay it through the API to run it again):
+#   DELIVERY_ID=<id printed by an earlier run> make test
 
 WEBHOOK_URL="${WEBHOOK_URL:-https://console.allinmedia.ai/tool/github-sentry/webhook}"
 
 # Try to read webhook secret from config.yml if not set as environment variable
+# Set WEBHOOK_SECRET when the repo uses a project or organization secret, or a rotation block
 if [ -z "$WEBHOOK_SECRET" ] && [ -f "config.yml" ]; then
   WEBHOOK_SECRET=$(grep "^github_webhook_secret:" config.yml | sed 's/^github_webhook_secret:[[:space:]]*//' | tr -d '\r\n' | sed 's/[[:space:]]*$//')
 fi
@@ -73,7 +76,9 @@ echo "Payload size: $(wc -c < "$TMP_PAYLOAD") bytes"
 echo ""
 
 # Generate a delivery ID (GitHub includes this in real webhooks)
-DELIVERY_ID=$(uuidgen 2>/dev/null || echo "$(date +%s)-$(openssl rand -hex 8)")
+# Deliveries are deduplicated by this ID, POST /deliveries/<id>/replay runs a repeated one anyway
+DELIVERY_ID="${DELIVERY_ID:-$(uuidgen 2>/dev/null || echo "$(date +%s)-$(openssl rand -hex 8)")}"
+echo "Delivery ID: $DELIVERY_ID"
 
 # Send POST request with proper headers using --data-binary to send exact bytes
 # Use -v for verbose output if DEBUG is set